@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDepartureWindow = time.Hour
+	defaultDepartureLimit  = 20
+)
+
+// Departure is one scheduled departure from a stop.
+type Departure struct {
+	FeedId         string    `json:"feed_id"`
+	StopId         string    `json:"stop_id"`
+	TripId         string    `json:"trip_id"`
+	StopSequence   int       `json:"stop_sequence"`
+	RouteId        string    `json:"route_id"`
+	RouteShortName string    `json:"route_short_name"`
+	TripHeadsign   string    `json:"trip_headsign"`
+	DepartureTime  GtfsTime  `json:"departure_time"`
+	ServiceDate    GtfsDate  `json:"service_date" db:"-"`
+	Departs        time.Time `json:"departs" db:"-"`
+	StopTimezone   string    `json:"-"`
+
+	// PredictedDeparture, Delay and ScheduleRelationship overlay
+	// GTFS-Realtime TripUpdates as on stop times.
+	PredictedDeparture   *time.Time `json:"predicted_departure,omitempty" db:"-"`
+	Delay                *int       `json:"delay,omitempty" db:"-"`
+	ScheduleRelationship string     `json:"schedule_relationship,omitempty" db:"-"`
+}
+
+// parseFrom reads the from parameter: an RFC 3339 instant, or a time of
+// day today as HH:MM or HH:MM:SS in the zone of now. Empty means now.
+func parseFrom(from string, now time.Time) (time.Time, error) {
+	if from == "" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, from); err == nil {
+		return t, nil
+	}
+
+	value := from
+	if strings.Count(value, ":") == 1 {
+		value += ":00"
+	}
+	seconds, err := parseGtfsTime(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid from %q, expected RFC 3339 or HH:MM[:SS]", from)
+	}
+	return serviceDayStart(now).Add(time.Duration(seconds) * time.Second), nil
+}
+
+// parseWindow reads the window parameter: a duration such as "90m", or
+// a number of minutes.
+func parseWindow(window string) (time.Duration, error) {
+	if window == "" {
+		return defaultDepartureWindow, nil
+	}
+	if minutes, err := strconv.Atoi(window); err == nil && minutes > 0 {
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	if d, err := time.ParseDuration(window); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid window %q", window)
+}
+
+// parseLimit reads a positive limit parameter, defaulting when empty.
+func parseLimit(limit string, fallback int) (int, error) {
+	if limit == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid limit %q", limit)
+	}
+	return n, nil
+}
+
+// Departures lists the departures from a stop on every route within the
+// window after from, soonest first. Trips of the previous service day
+// still running after midnight are included alongside today's. A time of
+// day in from is local to the stop in each feed. Departures keep their
+// scheduled order when realtime TripUpdates predict them.
+func (serv TransitService) Departures(stopId string, from string, window string, limit string, feed string) []Departure {
+	stops, err := dbMap.SelectInt("select count(*) from stop where stopid = :stopId and (:feed = '' or feedid = :feed)", map[string]interface{}{
+		"stopId": stopId,
+		"feed":   feed,
+	})
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return []Departure{}
+	}
+	if stops == 0 {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(fmt.Sprintf("stop %q not found", stopId)))
+		return []Departure{}
+	}
+
+	if _, err := parseFrom(from, time.Now()); err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return []Departure{}
+	}
+	length, err := parseWindow(window)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return []Departure{}
+	}
+	max, err := parseLimit(limit, defaultDepartureLimit)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return []Departure{}
+	}
+
+	departures, err := serv.upcomingDepartures(stopId, from, length, max, feed)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return []Departure{}
+	}
+
+	if err := overlayDepartures(departures); err != nil {
+		log.Println("Overlaying realtime on departures from stop", stopId, "failed.", err)
+	}
+	return departures
+}
+
+// overlayDepartures sets the predictions of the latest TripUpdates on
+// departures, by way of the stop times they depart at.
+func overlayDepartures(departures []Departure) error {
+	stopTimes := make([]StopTime, len(departures))
+	for i, departure := range departures {
+		date, departs := departure.ServiceDate, departure.Departs
+		stopTimes[i] = StopTime{
+			FeedId:        departure.FeedId,
+			TripId:        departure.TripId,
+			StopId:        departure.StopId,
+			StopSequence:  departure.StopSequence,
+			DepartureTime: departure.DepartureTime,
+			ServiceDate:   &date,
+			DepartsAt:     &departs,
+		}
+	}
+
+	if err := overlayRealtime(stopTimes); err != nil {
+		return err
+	}
+	for i, st := range stopTimes {
+		departures[i].PredictedDeparture = st.PredictedDeparture
+		departures[i].Delay = st.Delay
+		departures[i].ScheduleRelationship = st.ScheduleRelationship
+	}
+	return nil
+}
+
+// upcomingDepartures finds the departures from a stop within window of
+// from, read in the stop's timezone in each feed. Each feed's stop times
+// count from the start of its own service days, so the day start falls
+// on and the day before, for trips running past midnight, are both
+// searched in the feed's timezone.
+func (serv TransitService) upcomingDepartures(stopId string, from string, window time.Duration, limit int, feed string) ([]Departure, error) {
+	all := []Departure{}
+
+	feedIds, err := feedIdsFor(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, feedId := range feedIds {
+		stopTimezone, err := dbMap.SelectNullStr("select coalesce(stoptimezone, '') from stop where feedid = :feed and stopid = :stopId", map[string]interface{}{
+			"feed":   feedId,
+			"stopId": stopId,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !stopTimezone.Valid {
+			// The stop is not in this feed.
+			continue
+		}
+		start, err := parseFrom(from, time.Now().In(stopLocation(feedId, stopTimezone.String)))
+		if err != nil {
+			return nil, err
+		}
+		end := start.Add(window)
+
+		today := serviceDayStart(start.In(feedLocation(feedId)))
+		for _, day := range []time.Time{serviceDayStart(today.Add(-12 * time.Hour)), today} {
+			services, err := serv.activeServices(feedId, serviceDayOf(day))
+			if err != nil {
+				return nil, err
+			}
+			if services.empty() {
+				continue
+			}
+
+			some := []Departure{}
+			query := "select st.feedid, st.stopid, st.tripid, st.stopsequence, st.departuretime, t.routeid, r.routeshortname, t.tripheadsign, s.stoptimezone " +
+				"from stoptime st " +
+				"join trip t on t.feedid = st.feedid and t.tripid = st.tripid " +
+				"join route r on r.feedid = t.feedid and r.routeid = t.routeid " +
+				"join stop s on s.feedid = st.feedid and s.stopid = st.stopid " +
+				"where st.stopid = :stopId and st.feedid = :feed " +
+				"and (t.feedid, t.serviceid) in " + activeServiceSQL + " " +
+				"and st.departuretime >= :start and st.departuretime < :end and st.pickuptype <> '1' " +
+				"order by st.departuretime limit :limit"
+
+			_, err = dbMap.Select(&some, query, services.bind(map[string]interface{}{
+				"stopId": stopId,
+				"feed":   feedId,
+				"start":  int(start.Sub(day) / time.Second),
+				"end":    int(end.Sub(day) / time.Second),
+				"limit":  limit,
+			}))
+			if err != nil {
+				return nil, err
+			}
+
+			for i := range some {
+				some[i].ServiceDate = serviceDate(day)
+				some[i].Departs = day.Add(time.Duration(some[i].DepartureTime) * time.Second).
+					In(stopLocation(feedId, some[i].StopTimezone))
+			}
+			all = append(all, some...)
+		}
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Departs.Before(all[j].Departs)
+	})
+	if len(all) > limit {
+		all = all[:limit]
+	}
+
+	return all, nil
+}
+
+// placeOn sets the service date of a stop time and the instants it
+// arrives and departs, counting from the start of its service day.
+func (st *StopTime) placeOn(start time.Time) {
+	date := serviceDate(start)
+	st.ServiceDate = &date
+
+	if st.ArrivalTime.Valid() {
+		arrives := start.Add(time.Duration(st.ArrivalTime) * time.Second)
+		st.ArrivesAt = &arrives
+	}
+	if st.DepartureTime.Valid() {
+		departs := start.Add(time.Duration(st.DepartureTime) * time.Second)
+		st.DepartsAt = &departs
+	}
+}
+
+// sortStopTimes orders placed stop times by when they depart, or arrive
+// for the last stop of a trip. Untimed stop times keep their place
+// relative to one another at the end.
+func sortStopTimes(all []StopTime) {
+	instant := func(st StopTime) *time.Time {
+		if st.DepartsAt != nil {
+			return st.DepartsAt
+		}
+		return st.ArrivesAt
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		a, b := instant(all[i]), instant(all[j])
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return a.Before(*b)
+	})
+}
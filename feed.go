@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// feedFile is one file of a GTFS feed, wherever the feed came from.
+type feedFile struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+// gtfsFeed is an opened GTFS feed: a zip archive or a directory of .txt
+// files.
+type gtfsFeed struct {
+	source  string
+	files   []feedFile
+	cleanup []func() error
+}
+
+// Close releases the feed and removes any temporary files behind it.
+func (feed *gtfsFeed) Close() error {
+	var err error
+	for i := len(feed.cleanup) - 1; i >= 0; i-- {
+		if e := feed.cleanup[i](); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// sort puts the files in gtfsFileOrder, so referenced files come first.
+func (feed *gtfsFeed) sort() {
+	sort.SliceStable(feed.files, func(i, j int) bool {
+		return fileRank(feed.files[i].name) < fileRank(feed.files[j].name)
+	})
+}
+
+// openFeed opens a GTFS feed from an http(s) URL, a local zip file or a
+// local directory of unzipped .txt files.
+func openFeed(source string) (*gtfsFeed, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		zipPath, err := downloadDataset(source)
+		if err != nil {
+			return nil, err
+		}
+		return openZipFeed(zipPath, true)
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return openDirFeed(source)
+	}
+	return openZipFeed(source, false)
+}
+
+// openZipFeed opens a zipped GTFS feed. A temporary archive is deleted
+// when the feed is closed.
+func openZipFeed(zipPath string, temporary bool) (*gtfsFeed, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		if temporary {
+			os.Remove(zipPath)
+		}
+		return nil, err
+	}
+
+	feed := &gtfsFeed{source: zipPath}
+	feed.cleanup = append(feed.cleanup, r.Close)
+	if temporary {
+		feed.cleanup = append(feed.cleanup, func() error { return os.Remove(zipPath) })
+	}
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		feed.files = append(feed.files, feedFile{
+			name: path.Base(f.Name),
+			open: f.Open,
+		})
+	}
+
+	feed.sort()
+	return feed, nil
+}
+
+// openDirFeed opens a directory holding the .txt files of a GTFS feed.
+func openDirFeed(dir string) (*gtfsFeed, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no .txt files in %s", dir)
+	}
+
+	feed := &gtfsFeed{source: dir}
+	for _, match := range matches {
+		fileName := match
+		feed.files = append(feed.files, feedFile{
+			name: filepath.Base(fileName),
+			open: func() (io.ReadCloser, error) { return os.Open(fileName) },
+		})
+	}
+
+	feed.sort()
+	return feed, nil
+}
+
+// isUpload reports whether a posted body is a feed itself rather than
+// the location of one.
+func isUpload(body string, contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "multipart/form-data", "application/zip", "application/x-zip-compressed", "application/octet-stream":
+		return true
+	}
+	return strings.HasPrefix(body, "PK\x03\x04")
+}
+
+// saveUpload writes a zipped feed posted either as the raw body or as the
+// first file part of a multipart form to a temporary file.
+func saveUpload(body string, contentType string) (string, error) {
+	var in io.Reader = strings.NewReader(body)
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType == "multipart/form-data" {
+		form := multipart.NewReader(strings.NewReader(body), params["boundary"])
+		for {
+			part, err := form.NextPart()
+			if err == io.EOF {
+				return "", errors.New("no file in multipart upload")
+			}
+			if err != nil {
+				return "", err
+			}
+			if part.FileName() != "" {
+				in = part
+				break
+			}
+		}
+	}
+
+	outfile, err := ioutil.TempFile("", "tamer-upload-")
+	if err != nil {
+		return "", err
+	}
+	defer outfile.Close()
+
+	n, err := io.Copy(outfile, in)
+	if err != nil {
+		os.Remove(outfile.Name())
+		return "", err
+	}
+
+	log.Println(n, "bytes uploaded to", outfile.Name())
+	return outfile.Name(), nil
+}
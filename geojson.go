@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/paulmach/go.geojson"
+)
+
+// geoJSONMime is the media type of GeoJSON responses.
+const geoJSONMime = "application/geo+json"
+
+// wantsGeoJSON tells whether a request asked for a GeoJSON response,
+// either with format=geojson or by accepting application/geo+json.
+// format=json asks for plain JSON whatever is accepted.
+func (serv TransitService) wantsGeoJSON(format string) (bool, error) {
+	switch format {
+	case "geojson":
+		return true, nil
+	case "json":
+		return false, nil
+	case "":
+		return strings.Contains(serv.Context.Request().Header.Get("Accept"), geoJSONMime), nil
+	}
+	return false, fmt.Errorf("invalid format %q, expected json or geojson", format)
+}
+
+// writeGeoJSON responds with a feature collection in place of the
+// endpoint's JSON output.
+func (serv TransitService) writeGeoJSON(collection *geojson.FeatureCollection) {
+	body, err := json.Marshal(collection)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return
+	}
+	serv.ResponseBuilder().SetContentType(geoJSONMime).WriteAndOveride(body)
+}
+
+// featureProperties returns the JSON fields of v as feature properties,
+// so they are named as in the plain JSON responses.
+func featureProperties(v interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	if body, err := json.Marshal(v); err == nil {
+		json.Unmarshal(body, &properties)
+	}
+	return properties
+}
+
+// stopFeatures returns a point feature for each stop.
+func stopFeatures(stops []Stop) *geojson.FeatureCollection {
+	collection := geojson.NewFeatureCollection()
+	for _, stop := range stops {
+		collection.AddFeature(stopFeature(stop, stop))
+	}
+	return collection
+}
+
+// stopFeature returns a point at a stop with the fields of v, the stop
+// or a type embedding it, less the coordinates.
+func stopFeature(stop Stop, v interface{}) *geojson.Feature {
+	feature := geojson.NewPointFeature([]float64{stop.StopLon, stop.StopLat})
+	feature.Properties = featureProperties(v)
+	delete(feature.Properties, "stop_lat")
+	delete(feature.Properties, "stop_lon")
+	return feature
+}
+
+// shapeFeatures returns a line feature for each shape.
+func shapeFeatures(lines []shapeLine) *geojson.FeatureCollection {
+	collection := geojson.NewFeatureCollection()
+	for _, line := range lines {
+		feature := line.path.ToGeoJSON()
+		feature.SetProperty("feed_id", line.FeedId)
+		feature.SetProperty("shape_id", line.ShapeId)
+		collection.AddFeature(feature)
+	}
+	return collection
+}
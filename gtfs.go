@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvHeader maps GTFS column names to their position in a record, so
+// feeds can order, omit or add columns freely.
+type csvHeader map[string]int
+
+// newCSVHeader builds a csvHeader from the first record of a GTFS file,
+// ignoring a leading UTF-8 byte order mark and stray whitespace.
+func newCSVHeader(record []string) csvHeader {
+	header := csvHeader{}
+	for i, name := range record {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		header[strings.TrimSpace(name)] = i
+	}
+	return header
+}
+
+// get returns the value of the named column in record, or an empty
+// string if the column is absent from the file or the record is short.
+func (h csvHeader) get(record []string, column string) string {
+	i, ok := h[column]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+// missing returns the columns from the list that the header lacks.
+func (h csvHeader) missing(columns []string) []string {
+	absent := []string{}
+	for _, column := range columns {
+		if _, ok := h[column]; !ok {
+			absent = append(absent, column)
+		}
+	}
+	return absent
+}
+
+// unknown returns the header columns that appear in neither list.
+func (h csvHeader) unknown(required []string, optional []string) []string {
+	known := map[string]bool{}
+	for _, column := range required {
+		known[column] = true
+	}
+	for _, column := range optional {
+		known[column] = true
+	}
+
+	extra := []string{}
+	for column := range h {
+		if !known[column] {
+			extra = append(extra, column)
+		}
+	}
+	return extra
+}
+
+// gtfsFile describes how one file of a GTFS feed maps onto a table.
+type gtfsFile struct {
+	required []string
+	optional []string
+	record   func(h csvHeader, r []string) interface{}
+}
+
+var gtfsFiles = map[string]gtfsFile{
+	"agency.txt": {
+		required: []string{"agency_name", "agency_url", "agency_timezone"},
+		optional: []string{"agency_id", "agency_lang", "agency_phone", "agency_fare_url", "agency_email"},
+		record: func(h csvHeader, r []string) interface{} {
+			return &Agency{
+				AgencyId:       h.get(r, "agency_id"),
+				AgencyName:     h.get(r, "agency_name"),
+				AgencyUrl:      h.get(r, "agency_url"),
+				AgencyTimezone: h.get(r, "agency_timezone"),
+				AgencyLang:     h.get(r, "agency_lang"),
+				AgencyPhone:    h.get(r, "agency_phone"),
+			}
+		},
+	},
+	"calendar.txt": {
+		required: []string{"service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday", "start_date", "end_date"},
+		record: func(h csvHeader, r []string) interface{} {
+			return &Calendar{
+				ServiceId: h.get(r, "service_id"),
+				Monday:    h.get(r, "monday"),
+				Tuesday:   h.get(r, "tuesday"),
+				Wednesday: h.get(r, "wednesday"),
+				Thursday:  h.get(r, "thursday"),
+				Friday:    h.get(r, "friday"),
+				Saturday:  h.get(r, "saturday"),
+				Sunday:    h.get(r, "sunday"),
+				StartDate: newGtfsDate(h.get(r, "start_date")),
+				EndDate:   newGtfsDate(h.get(r, "end_date")),
+			}
+		},
+	},
+	"calendar_dates.txt": {
+		required: []string{"service_id", "date", "exception_type"},
+		record: func(h csvHeader, r []string) interface{} {
+			exceptionType, _ := strconv.Atoi(h.get(r, "exception_type"))
+			return &CalendarDate{
+				ServiceId:     h.get(r, "service_id"),
+				Date:          newGtfsDate(h.get(r, "date")),
+				ExceptionType: exceptionType,
+			}
+		},
+	},
+	"routes.txt": {
+		required: []string{"route_id", "route_type"},
+		optional: []string{"agency_id", "route_short_name", "route_long_name", "route_desc", "route_url", "route_color", "route_text_color", "route_sort_order"},
+		record: func(h csvHeader, r []string) interface{} {
+			return &Route{
+				RouteId:        h.get(r, "route_id"),
+				AgencyId:       h.get(r, "agency_id"),
+				RouteShortName: h.get(r, "route_short_name"),
+				RouteLongName:  h.get(r, "route_long_name"),
+				RouteDesc:      h.get(r, "route_desc"),
+				RouteType:      h.get(r, "route_type"),
+				RouteUrl:       h.get(r, "route_url"),
+				RouteColor:     h.get(r, "route_color"),
+				RouteTextColor: h.get(r, "route_text_color"),
+			}
+		},
+	},
+	"shapes.txt": {
+		required: []string{"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence"},
+		optional: []string{"shape_dist_traveled"},
+		record: func(h csvHeader, r []string) interface{} {
+			lat, _ := strconv.ParseFloat(h.get(r, "shape_pt_lat"), 64)
+			lon, _ := strconv.ParseFloat(h.get(r, "shape_pt_lon"), 64)
+			seq, _ := strconv.Atoi(h.get(r, "shape_pt_sequence"))
+			return &Shape{
+				ShapeId:         h.get(r, "shape_id"),
+				ShapePtLat:      lat,
+				ShapePtLon:      lon,
+				ShapePtSequence: seq,
+			}
+		},
+	},
+	"stop_times.txt": {
+		required: []string{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence"},
+		optional: []string{"stop_headsign", "pickup_type", "drop_off_type", "shape_dist_traveled", "timepoint"},
+		record: func(h csvHeader, r []string) interface{} {
+			seq, _ := strconv.Atoi(h.get(r, "stop_sequence"))
+			return &StopTime{
+				TripId:        h.get(r, "trip_id"),
+				ArrivalTime:   newGtfsTime(h.get(r, "arrival_time")),
+				DepartureTime: newGtfsTime(h.get(r, "departure_time")),
+				StopId:        h.get(r, "stop_id"),
+				StopSequence:  seq,
+				PickupType:    h.get(r, "pickup_type"),
+				DropOffType:   h.get(r, "drop_off_type"),
+			}
+		},
+	},
+	"stops.txt": {
+		required: []string{"stop_id", "stop_name", "stop_lat", "stop_lon"},
+		optional: []string{"stop_code", "stop_desc", "zone_id", "stop_url", "location_type", "parent_station", "stop_timezone", "wheelchair_boarding", "level_id", "platform_code"},
+		record: func(h csvHeader, r []string) interface{} {
+			lat, _ := strconv.ParseFloat(h.get(r, "stop_lat"), 64)
+			lon, _ := strconv.ParseFloat(h.get(r, "stop_lon"), 64)
+			locationType, _ := strconv.Atoi(h.get(r, "location_type"))
+			return &Stop{
+				StopId:       h.get(r, "stop_id"),
+				StopCode:     h.get(r, "stop_code"),
+				StopName:     h.get(r, "stop_name"),
+				StopDesc:     h.get(r, "stop_desc"),
+				StopLat:      lat,
+				StopLon:      lon,
+				ZoneId:       h.get(r, "zone_id"),
+				StopUrl:      h.get(r, "stop_url"),
+				LocationType: locationType,
+				StopTimezone: h.get(r, "stop_timezone"),
+			}
+		},
+	},
+	"trips.txt": {
+		required: []string{"route_id", "service_id", "trip_id"},
+		optional: []string{"trip_headsign", "trip_short_name", "direction_id", "block_id", "shape_id", "wheelchair_accessible", "bikes_allowed"},
+		record: func(h csvHeader, r []string) interface{} {
+			directionId, _ := strconv.Atoi(h.get(r, "direction_id"))
+			return &Trip{
+				RouteId:      h.get(r, "route_id"),
+				ServiceId:    h.get(r, "service_id"),
+				TripId:       h.get(r, "trip_id"),
+				TripHeadsign: h.get(r, "trip_headsign"),
+				DirectionId:  directionId,
+				BlockId:      h.get(r, "block_id"),
+				ShapeId:      h.get(r, "shape_id"),
+			}
+		},
+	},
+	"frequencies.txt": {
+		required: []string{"trip_id", "start_time", "end_time", "headway_secs"},
+		optional: []string{"exact_times"},
+		record: func(h csvHeader, r []string) interface{} {
+			headway, _ := strconv.Atoi(h.get(r, "headway_secs"))
+			return &Frequency{
+				TripId:      h.get(r, "trip_id"),
+				StartTime:   newGtfsTime(h.get(r, "start_time")),
+				EndTime:     newGtfsTime(h.get(r, "end_time")),
+				HeadwaySecs: headway,
+				ExactTimes:  h.get(r, "exact_times"),
+			}
+		},
+	},
+	"transfers.txt": {
+		required: []string{"transfer_type"},
+		optional: []string{"from_stop_id", "to_stop_id", "from_route_id", "to_route_id", "from_trip_id", "to_trip_id", "min_transfer_time"},
+		record: func(h csvHeader, r []string) interface{} {
+			minTime, _ := strconv.Atoi(h.get(r, "min_transfer_time"))
+			return &Transfer{
+				FromStopId:      h.get(r, "from_stop_id"),
+				ToStopId:        h.get(r, "to_stop_id"),
+				FromRouteId:     h.get(r, "from_route_id"),
+				ToRouteId:       h.get(r, "to_route_id"),
+				FromTripId:      h.get(r, "from_trip_id"),
+				ToTripId:        h.get(r, "to_trip_id"),
+				TransferType:    h.get(r, "transfer_type"),
+				MinTransferTime: minTime,
+			}
+		},
+	},
+	"feed_info.txt": {
+		required: []string{"feed_publisher_name", "feed_publisher_url", "feed_lang"},
+		optional: []string{"default_lang", "feed_start_date", "feed_end_date", "feed_version", "feed_contact_email", "feed_contact_url"},
+		record: func(h csvHeader, r []string) interface{} {
+			return &FeedInfo{
+				FeedPublisherName: h.get(r, "feed_publisher_name"),
+				FeedPublisherUrl:  h.get(r, "feed_publisher_url"),
+				FeedLang:          h.get(r, "feed_lang"),
+				DefaultLang:       h.get(r, "default_lang"),
+				FeedStartDate:     h.get(r, "feed_start_date"),
+				FeedEndDate:       h.get(r, "feed_end_date"),
+				FeedVersion:       h.get(r, "feed_version"),
+				FeedContactEmail:  h.get(r, "feed_contact_email"),
+				FeedContactUrl:    h.get(r, "feed_contact_url"),
+			}
+		},
+	},
+	"fare_attributes.txt": {
+		required: []string{"fare_id", "price", "currency_type", "payment_method", "transfers"},
+		optional: []string{"agency_id", "transfer_duration"},
+		record: func(h csvHeader, r []string) interface{} {
+			price, _ := strconv.ParseFloat(h.get(r, "price"), 64)
+			duration, _ := strconv.Atoi(h.get(r, "transfer_duration"))
+			return &FareAttribute{
+				FareId:           h.get(r, "fare_id"),
+				Price:            price,
+				CurrencyType:     h.get(r, "currency_type"),
+				PaymentMethod:    h.get(r, "payment_method"),
+				Transfers:        h.get(r, "transfers"),
+				AgencyId:         h.get(r, "agency_id"),
+				TransferDuration: duration,
+			}
+		},
+	},
+	"fare_rules.txt": {
+		required: []string{"fare_id"},
+		optional: []string{"route_id", "origin_id", "destination_id", "contains_id"},
+		record: func(h csvHeader, r []string) interface{} {
+			return &FareRule{
+				FareId:        h.get(r, "fare_id"),
+				RouteId:       h.get(r, "route_id"),
+				OriginId:      h.get(r, "origin_id"),
+				DestinationId: h.get(r, "destination_id"),
+				ContainsId:    h.get(r, "contains_id"),
+			}
+		},
+	},
+	"levels.txt": {
+		required: []string{"level_id", "level_index"},
+		optional: []string{"level_name"},
+		record: func(h csvHeader, r []string) interface{} {
+			index, _ := strconv.ParseFloat(h.get(r, "level_index"), 64)
+			return &Level{
+				LevelId:    h.get(r, "level_id"),
+				LevelIndex: index,
+				LevelName:  h.get(r, "level_name"),
+			}
+		},
+	},
+	"pathways.txt": {
+		required: []string{"pathway_id", "from_stop_id", "to_stop_id", "pathway_mode", "is_bidirectional"},
+		optional: []string{"length", "traversal_time", "stair_count", "max_slope", "min_width", "signposted_as", "reversed_signposted_as"},
+		record: func(h csvHeader, r []string) interface{} {
+			length, _ := strconv.ParseFloat(h.get(r, "length"), 64)
+			traversal, _ := strconv.Atoi(h.get(r, "traversal_time"))
+			stairs, _ := strconv.Atoi(h.get(r, "stair_count"))
+			slope, _ := strconv.ParseFloat(h.get(r, "max_slope"), 64)
+			width, _ := strconv.ParseFloat(h.get(r, "min_width"), 64)
+			return &Pathway{
+				PathwayId:            h.get(r, "pathway_id"),
+				FromStopId:           h.get(r, "from_stop_id"),
+				ToStopId:             h.get(r, "to_stop_id"),
+				PathwayMode:          h.get(r, "pathway_mode"),
+				IsBidirectional:      h.get(r, "is_bidirectional"),
+				Length:               length,
+				TraversalTime:        traversal,
+				StairCount:           stairs,
+				MaxSlope:             slope,
+				MinWidth:             width,
+				SignpostedAs:         h.get(r, "signposted_as"),
+				ReversedSignpostedAs: h.get(r, "reversed_signposted_as"),
+			}
+		},
+	},
+	"attributions.txt": {
+		required: []string{"organization_name"},
+		optional: []string{"attribution_id", "agency_id", "route_id", "trip_id", "is_producer", "is_operator", "is_authority", "attribution_url", "attribution_email", "attribution_phone"},
+		record: func(h csvHeader, r []string) interface{} {
+			return &Attribution{
+				AttributionId:    h.get(r, "attribution_id"),
+				AgencyId:         h.get(r, "agency_id"),
+				RouteId:          h.get(r, "route_id"),
+				TripId:           h.get(r, "trip_id"),
+				OrganizationName: h.get(r, "organization_name"),
+				IsProducer:       h.get(r, "is_producer"),
+				IsOperator:       h.get(r, "is_operator"),
+				IsAuthority:      h.get(r, "is_authority"),
+				AttributionUrl:   h.get(r, "attribution_url"),
+				AttributionEmail: h.get(r, "attribution_email"),
+				AttributionPhone: h.get(r, "attribution_phone"),
+			}
+		},
+	},
+	"translations.txt": {
+		required: []string{"table_name", "field_name", "language", "translation"},
+		optional: []string{"record_id", "record_sub_id", "field_value"},
+		record: func(h csvHeader, r []string) interface{} {
+			return &Translation{
+				TableName:   h.get(r, "table_name"),
+				FieldName:   h.get(r, "field_name"),
+				Language:    h.get(r, "language"),
+				Translation: h.get(r, "translation"),
+				RecordId:    h.get(r, "record_id"),
+				RecordSubId: h.get(r, "record_sub_id"),
+				FieldValue:  h.get(r, "field_value"),
+			}
+		},
+	},
+}
+
+// gtfsFileOrder lists the GTFS files so that every file comes after the
+// files it refers to, letting references be checked as rows stream in.
+var gtfsFileOrder = []string{
+	"agency.txt",
+	"feed_info.txt",
+	"levels.txt",
+	"stops.txt",
+	"routes.txt",
+	"calendar.txt",
+	"calendar_dates.txt",
+	"shapes.txt",
+	"trips.txt",
+	"stop_times.txt",
+	"frequencies.txt",
+	"transfers.txt",
+	"pathways.txt",
+	"fare_attributes.txt",
+	"fare_rules.txt",
+	"attributions.txt",
+	"translations.txt",
+}
+
+// fileRank orders feed files by gtfsFileOrder, with unknown files last.
+func fileRank(name string) int {
+	for i, known := range gtfsFileOrder {
+		if known == name {
+			return i
+		}
+	}
+	return len(gtfsFileOrder)
+}
+
+// parseGtfsTime parses a GTFS H:MM:SS time into seconds since the start
+// of the service day. Hours may run past 24 for trips after midnight.
+func parseGtfsTime(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 || len(parts[1]) != 2 || len(parts[2]) != 2 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	seconds, err := strconv.Atoi(parts[2])
+	if err != nil || seconds < 0 || seconds > 59 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	return hours*3600 + minutes*60 + seconds, nil
+}
+
+// parseGtfsDate parses a GTFS YYYYMMDD date.
+func parseGtfsDate(value string) (time.Time, error) {
+	if len(value) != 8 {
+		return time.Time{}, fmt.Errorf("invalid date %q", value)
+	}
+	return time.Parse("20060102", value)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// tableCopy streams rows of one gorp-mapped type into its table using
+// the PostgreSQL COPY protocol.
+type tableCopy struct {
+	txn  *sql.Tx
+	stmt *sql.Stmt
+}
+
+// newTableCopy starts a COPY into the table mapped for the type of row,
+// within the given schema.
+func newTableCopy(schema string, row interface{}) (*tableCopy, error) {
+	t := reflect.TypeOf(row).Elem()
+
+	table, err := dbMap.TableFor(t, false)
+	if err != nil {
+		return nil, err
+	}
+
+	txn, err := dbMap.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyInSchema(schema, strings.ToLower(table.TableName), copyColumns(t)...))
+	if err != nil {
+		txn.Rollback()
+		return nil, err
+	}
+
+	return &tableCopy{txn: txn, stmt: stmt}, nil
+}
+
+// add queues one row. pq buffers and sends rows as the buffer fills,
+// so memory stays bounded regardless of the number of rows.
+func (c *tableCopy) add(row interface{}) error {
+	_, err := c.stmt.Exec(copyValues(row)...)
+	return err
+}
+
+// close flushes the remaining rows and commits the COPY.
+func (c *tableCopy) close() error {
+	if _, err := c.stmt.Exec(); err != nil {
+		c.stmt.Close()
+		c.txn.Rollback()
+		return err
+	}
+	if err := c.stmt.Close(); err != nil {
+		c.txn.Rollback()
+		return err
+	}
+	return c.txn.Commit()
+}
+
+// abort discards everything sent so far.
+func (c *tableCopy) abort() {
+	c.stmt.Close()
+	c.txn.Rollback()
+}
+
+// copyColumns returns the column names gorp uses for the fields of t.
+func copyColumns(t reflect.Type) []string {
+	columns := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("db")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		columns = append(columns, strings.ToLower(name))
+	}
+	return columns
+}
+
+// copyValues returns the field values of row in copyColumns order.
+func copyValues(row interface{}) []interface{} {
+	v := reflect.ValueOf(row).Elem()
+	t := v.Type()
+
+	values := []interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("db") == "-" {
+			continue
+		}
+		values = append(values, v.Field(i).Interface())
+	}
+	return values
+}
+
+// scanFile reads one GTFS file a single record at a time, checking each
+// record with the validator and passing the parsed row to fn. A file
+// missing required columns is reported and skipped.
+func scanFile(fileName string, spec gtfsFile, in io.Reader, validator *feedValidator, fn func(row interface{}) error) error {
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	first, err := reader.Read()
+	if err == io.EOF {
+		log.Printf("%s is empty", fileName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	header := newCSVHeader(first)
+	validator.header(fileName, spec, header)
+	if len(header.missing(spec.required)) > 0 {
+		return nil
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line, _ := reader.FieldPos(0)
+		validator.record(fileName, line, header, record)
+
+		if fn == nil {
+			continue
+		}
+		if err := fn(spec.record(header, record)); err != nil {
+			return fmt.Errorf("%s line %d: %v", fileName, line, err)
+		}
+	}
+}
+
+// importFile streams one GTFS file into its table in the staging schema
+// under the given feed ID and returns the number of rows written.
+func importFile(staging *stagingArea, validator *feedValidator, feedId string, fileName string, spec gtfsFile, in io.Reader) (int, error) {
+	var copier *tableCopy
+	rows := 0
+
+	err := scanFile(fileName, spec, in, validator, func(row interface{}) error {
+		reflect.ValueOf(row).Elem().FieldByName("FeedId").SetString(feedId)
+
+		if copier == nil {
+			var err error
+			if copier, err = newTableCopy(staging.schema, row); err != nil {
+				return err
+			}
+		}
+
+		if err := copier.add(row); err != nil {
+			return err
+		}
+		rows++
+		return nil
+	})
+
+	if copier == nil {
+		return rows, err
+	}
+	if err != nil {
+		copier.abort()
+		return rows, err
+	}
+
+	return rows, copier.close()
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/go.geo"
+	"github.com/paulmach/go.geojson"
+)
+
+const (
+	defaultIsochroneMinutes = 60
+	maxIsochroneMinutes     = 240
+	// defaultBandMinutes is how far apart the bands of a GeoJSON
+	// isochrone are unless a request gives them.
+	defaultBandMinutes = 15
+	// isochroneCell is the size, in metres, of the squares isochrone
+	// bands are drawn with.
+	isochroneCell = 100.0
+	// maxBandWalk is how far from the origin and each stop reached bands
+	// are drawn, in metres, however far a request lets journeys walk.
+	maxBandWalk = 1000.0
+	// maxIsochroneCells is how many squares a grid holds at most; places
+	// further out are left out of the bands.
+	maxIsochroneCells = 500000
+)
+
+// ReachedStop is a stop an isochrone reaches, with the earliest arrival
+// there.
+type ReachedStop struct {
+	Stop
+	Arrives    time.Time `json:"arrives"`
+	TravelTime int       `json:"travel_time"`
+	Transfers  int       `json:"transfers"`
+}
+
+// Isochrone is what can be reached from a place within a time: the
+// stops, soonest reached first, and the areas reachable within each
+// band of minutes when asked for.
+type Isochrone struct {
+	Stops []ReachedStop              `json:"stops"`
+	Bands *geojson.FeatureCollection `json:"bands,omitempty"`
+}
+
+// Isochrone finds the stops reachable from lat/lon within maxMinutes,
+// leaving at departAt as for Plan, by transit and walking up to maxWalk
+// metres to, from and between stops. bands, as comma-separated minutes,
+// asks for the areas reachable within each, drawn as walks of up to
+// maxBandWalk metres around the origin and the stops reached. As GeoJSON
+// the bands, every defaultBandMinutes unless given, come before the
+// stops.
+func (serv TransitService) Isochrone(lat string, lon string, departAt string, maxMinutes string, bands string, maxWalk string, feed string, format string) Isochrone {
+	result := Isochrone{Stops: []ReachedStop{}}
+
+	geoJSON, err := serv.wantsGeoJSON(format)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return result
+	}
+	latitude, err := strconv.ParseFloat(lat, 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid lat %q", lat)))
+		return result
+	}
+	longitude, err := strconv.ParseFloat(lon, 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid lon %q", lon)))
+		return result
+	}
+	if _, err := parseFrom(departAt, time.Now()); err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid departAt %q, expected RFC 3339 or HH:MM[:SS]", departAt)))
+		return result
+	}
+	minutes := defaultIsochroneMinutes
+	if maxMinutes != "" {
+		if minutes, err = strconv.Atoi(maxMinutes); err != nil || minutes <= 0 || minutes > maxIsochroneMinutes {
+			serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid maxMinutes %q, expected 1 to %d", maxMinutes, maxIsochroneMinutes)))
+			return result
+		}
+	}
+	walk := defaultPlanWalk
+	if maxWalk != "" {
+		if walk, err = strconv.ParseFloat(maxWalk, 64); err != nil || walk < 0 || walk > maxPlanWalk {
+			serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid maxWalk %q, expected 0 to %v metres", maxWalk, maxPlanWalk)))
+			return result
+		}
+	}
+	limits, err := parseBands(bands, minutes)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return result
+	}
+	if geoJSON && len(limits) == 0 {
+		for band := defaultBandMinutes; band < minutes; band += defaultBandMinutes {
+			limits = append(limits, band)
+		}
+		limits = append(limits, minutes)
+	}
+
+	feedIds, err := feedIdsFor(feed)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return result
+	}
+
+	origin := geo.NewPoint(longitude, latitude)
+	for _, feedId := range feedIds {
+		reached, err := reachStops(feedId, origin, departAt, minutes*60, walk)
+		if err != nil {
+			serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+			return Isochrone{Stops: []ReachedStop{}}
+		}
+		result.Stops = append(result.Stops, reached...)
+	}
+	sort.SliceStable(result.Stops, func(i, j int) bool {
+		return result.Stops[i].TravelTime < result.Stops[j].TravelTime
+	})
+
+	if len(limits) > 0 {
+		grid := newReachGrid(origin)
+		grid.reach(origin, 0, minutes*60, walk)
+		for i := range result.Stops {
+			grid.reach(stopPoint(&result.Stops[i].Stop), result.Stops[i].TravelTime, minutes*60, walk)
+		}
+
+		result.Bands = geojson.NewFeatureCollection()
+		for _, band := range limits {
+			feature := geojson.NewMultiPolygonFeature(grid.band(band * 60)...)
+			feature.SetProperty("minutes", band)
+			result.Bands.AddFeature(feature)
+		}
+	}
+
+	if geoJSON {
+		for _, stop := range result.Stops {
+			result.Bands.AddFeature(stopFeature(stop.Stop, stop))
+		}
+		serv.writeGeoJSON(result.Bands)
+	}
+	return result
+}
+
+// parseBands reads the bands parameter, minutes up to maxMinutes
+// separated by commas, in increasing order.
+func parseBands(bands string, maxMinutes int) ([]int, error) {
+	limits := []int{}
+	if bands == "" {
+		return limits, nil
+	}
+	for _, value := range strings.Split(bands, ",") {
+		band, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || band <= 0 || band > maxMinutes {
+			return nil, fmt.Errorf("invalid bands %q, expected minutes from 1 to %d", bands, maxMinutes)
+		}
+		limits = append(limits, band)
+	}
+	sort.Ints(limits)
+	return limits, nil
+}
+
+// reachStops searches one feed for the stops reachable from a point
+// within limit seconds of leaving at departAt.
+func reachStops(feedId string, origin *geo.Point, departAt string, limit int, maxWalk float64) ([]ReachedStop, error) {
+	loc := feedLocation(feedId)
+	instant, err := parseFrom(departAt, time.Now().In(loc))
+	if err != nil {
+		return nil, err
+	}
+	start := serviceDayStart(instant.In(loc))
+
+	tt, err := timetableFor(feedId, start)
+	if err != nil {
+		return nil, err
+	}
+	access, _, _ := tt.walksAround(planPlace{point: origin}, maxWalk)
+	depart := int(instant.Sub(start) / time.Second)
+	labels, _ := tt.raptor(depart, depart+limit, access, nil, maxPlanTransfers+1)
+
+	reached := []ReachedStop{}
+	for stop := range tt.stops {
+		// Later rounds only label stops they reach sooner, so the last
+		// label of a stop is its earliest arrival.
+		for k := len(labels) - 1; k >= 0; k-- {
+			t := labels[k][stop].time
+			if t == unreached {
+				continue
+			}
+			transfers := 0
+			if k > 1 {
+				transfers = k - 1
+			}
+			reached = append(reached, ReachedStop{
+				Stop:       tt.stops[stop],
+				Arrives:    tt.start.Add(time.Duration(t) * time.Second),
+				TravelTime: t - depart,
+				Transfers:  transfers,
+			})
+			break
+		}
+	}
+	return reached, nil
+}
+
+// reachGrid holds how soon, in seconds from leaving, each square of a
+// grid isochroneCell metres wide can be walked to.
+type reachGrid struct {
+	latStep float64
+	lngStep float64
+	seconds map[[2]int]int
+}
+
+// newReachGrid returns an empty grid whose squares are isochroneCell
+// metres wide around center.
+func newReachGrid(center *geo.Point) *reachGrid {
+	latStep := isochroneCell / geo.EarthRadius * 180 / math.Pi
+	return &reachGrid{
+		latStep: latStep,
+		lngStep: latStep / math.Cos(center.Lat()*math.Pi/180),
+		seconds: map[[2]int]int{},
+	}
+}
+
+// reach records the squares that can be walked to by limit, no further
+// than maxWalk or maxBandWalk, from a point reached seconds after
+// leaving. Once the grid holds maxIsochroneCells squares only those it
+// has are updated.
+func (grid *reachGrid) reach(p *geo.Point, seconds int, limit int, maxWalk float64) {
+	radius := math.Min(math.Min(maxWalk, maxBandWalk), float64(limit-seconds)*walkSpeed)
+	if radius < 0 {
+		return
+	}
+
+	bound := geo.NewGeoBoundAroundPoint(p, radius)
+	south, west := grid.cell(bound.SouthWest())
+	north, east := grid.cell(bound.NorthEast())
+	for row := south; row <= north; row++ {
+		for col := west; col <= east; col++ {
+			center := geo.NewPoint((float64(col)+0.5)*grid.lngStep, (float64(row)+0.5)*grid.latStep)
+			distance := p.GeoDistanceFrom(center, true)
+			if distance > radius {
+				continue
+			}
+			cell := [2]int{row, col}
+			t, ok := grid.seconds[cell]
+			if !ok && len(grid.seconds) >= maxIsochroneCells {
+				continue
+			}
+			if !ok || seconds+walkSeconds(distance) < t {
+				grid.seconds[cell] = seconds + walkSeconds(distance)
+			}
+		}
+	}
+}
+
+// cell returns the row and column of the square holding a point.
+func (grid *reachGrid) cell(p *geo.Point) (int, int) {
+	return int(math.Floor(p.Lat() / grid.latStep)), int(math.Floor(p.Lng() / grid.lngStep))
+}
+
+// band returns the squares reached by limit as the polygons of a
+// MultiPolygon: their outlines traced around them, with holes where
+// squares are not reached. Polygons only touch at corners.
+func (grid *reachGrid) band(limit int) [][][][]float64 {
+	reached := map[[2]int]bool{}
+	for cell, t := range grid.seconds {
+		if t <= limit {
+			reached[cell] = true
+		}
+	}
+
+	rings := traceCells(reached)
+	polygons := [][][][]float64{}
+	outers, holes := [][][2]int{}, [][][2]int{}
+	for _, ring := range rings {
+		if ringArea(ring) > 0 {
+			outers = append(outers, ring)
+			polygons = append(polygons, [][][]float64{grid.coordinates(ring)})
+		} else {
+			holes = append(holes, ring)
+		}
+	}
+
+	// A hole belongs to the smallest outline around the square on the
+	// left of where it starts, which is reached.
+	for _, hole := range holes {
+		row, col := sign(hole[1][0]-hole[0][0]), sign(hole[1][1]-hole[0][1])
+		x := float64(hole[0][1]) + float64(col-row)/2
+		y := float64(hole[0][0]) + float64(row+col)/2
+		owner := -1
+		for i, outer := range outers {
+			if ringContains(outer, x, y) && (owner < 0 || ringArea(outer) < ringArea(outers[owner])) {
+				owner = i
+			}
+		}
+		if owner >= 0 {
+			polygons[owner] = append(polygons[owner], grid.coordinates(hole))
+		}
+	}
+	return polygons
+}
+
+// coordinates returns a ring of grid corners as longitudes and
+// latitudes.
+func (grid *reachGrid) coordinates(ring [][2]int) [][]float64 {
+	coordinates := make([][]float64, 0, len(ring)+1)
+	for _, corner := range append(ring, ring[0]) {
+		coordinates = append(coordinates, []float64{float64(corner[1]) * grid.lngStep, float64(corner[0]) * grid.latStep})
+	}
+	return coordinates
+}
+
+// traceCells returns the rings of corners, as row and column, around a
+// set of squares given by row and column. Outlines run counterclockwise
+// and holes clockwise, keeping the squares on their left; where two
+// squares touch only at a corner their rings turn away from each other,
+// and no ring passes a corner twice.
+func traceCells(cells map[[2]int]bool) [][][2]int {
+	// Edges of squares with no square across them, by the corner they
+	// leave from.
+	edges := map[[2]int][][2]int{}
+	for cell := range cells {
+		row, col := cell[0], cell[1]
+		sides := []struct {
+			across   [2]int
+			from, to [2]int
+		}{
+			{[2]int{row - 1, col}, [2]int{row, col}, [2]int{row, col + 1}},
+			{[2]int{row, col + 1}, [2]int{row, col + 1}, [2]int{row + 1, col + 1}},
+			{[2]int{row + 1, col}, [2]int{row + 1, col + 1}, [2]int{row + 1, col}},
+			{[2]int{row, col - 1}, [2]int{row + 1, col}, [2]int{row, col}},
+		}
+		for _, side := range sides {
+			if !cells[side.across] {
+				edges[side.from] = append(edges[side.from], side.to)
+			}
+		}
+	}
+
+	starts := make([][2]int, 0, len(edges))
+	for corner := range edges {
+		starts = append(starts, corner)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i][0] < starts[j][0] || starts[i][0] == starts[j][0] && starts[i][1] < starts[j][1]
+	})
+
+	rings := [][][2]int{}
+	for _, first := range starts {
+		for len(edges[first]) > 0 {
+			ring := [][2]int{first}
+			at := map[[2]int]int{first: 0}
+			from, to := first, edges[first][0]
+			edges[first] = edges[first][1:]
+			for to != first {
+				next := edges[to]
+				// Turn left where two edges leave a corner.
+				choice := 0
+				if len(next) > 1 && turn(from, to, next[1]) > turn(from, to, next[0]) {
+					choice = 1
+				}
+				// A ring coming back to a corner it passed closes a loop
+				// there, kept as a ring of its own so no ring touches
+				// itself.
+				if i, ok := at[to]; ok {
+					loop := ring[i:]
+					for _, corner := range loop {
+						delete(at, corner)
+					}
+					rings = append(rings, straighten(loop))
+					ring = ring[:i:i]
+				}
+				at[to] = len(ring)
+				ring = append(ring, to)
+				from, to = to, next[choice]
+				edges[from] = append(next[:choice:choice], next[choice+1:]...)
+			}
+			rings = append(rings, straighten(ring))
+		}
+	}
+	return rings
+}
+
+// turn is positive where going from a through b to c turns left,
+// negative where it turns right.
+func turn(a [2]int, b [2]int, c [2]int) int {
+	return (b[1]-a[1])*(c[0]-b[0]) - (b[0]-a[0])*(c[1]-b[1])
+}
+
+// straighten drops the corners of a ring that lie along a straight edge.
+func straighten(ring [][2]int) [][2]int {
+	n := len(ring)
+	kept := [][2]int{}
+	for i := range ring {
+		if turn(ring[(i+n-1)%n], ring[i], ring[(i+1)%n]) != 0 {
+			kept = append(kept, ring[i])
+		}
+	}
+	return kept
+}
+
+// ringArea returns twice the signed area of a ring of corners, positive
+// when it runs counterclockwise.
+func ringArea(ring [][2]int) int {
+	area := 0
+	for i := range ring {
+		a, b := ring[i], ring[(i+1)%len(ring)]
+		area += a[1]*b[0] - b[1]*a[0]
+	}
+	return area
+}
+
+// sign returns -1, 0 or 1 as n is negative, zero or positive.
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// ringContains tells whether a point, given as column and row, lies
+// inside a ring of corners.
+func ringContains(ring [][2]int, x float64, y float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		yi, yj := float64(ring[i][0]), float64(ring[j][0])
+		xi, xj := float64(ring[i][1]), float64(ring[j][1])
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+)
+
+// testCells reads squares drawn as rows of '#' for those in the set.
+func testCells(rows ...string) map[[2]int]bool {
+	cells := map[[2]int]bool{}
+	for row, line := range rows {
+		for col, c := range line {
+			if c == '#' {
+				cells[[2]int{row, col}] = true
+			}
+		}
+	}
+	return cells
+}
+
+func TestTraceCells(t *testing.T) {
+	tests := []struct {
+		name   string
+		cells  []string
+		outers int
+		holes  int
+	}{
+		{"one square", []string{"#"}, 1, 0},
+		{"an L", []string{"#.", "##"}, 1, 0},
+		{"touching at a corner", []string{".#", "#."}, 2, 0},
+		{"a ring", []string{"###", "#.#", "###"}, 1, 1},
+		{"an island in a lake", []string{"#####", "#...#", "#.#.#", "#...#", "#####"}, 2, 1},
+		{"holes touching at a corner", []string{"####", "#.##", "##.#", "####"}, 1, 2},
+	}
+	for _, test := range tests {
+		cells := testCells(test.cells...)
+		outers, holes, area := 0, 0, 0
+		for _, ring := range traceCells(cells) {
+			seen := map[[2]int]bool{}
+			for _, corner := range ring {
+				if seen[corner] {
+					t.Errorf("%s: ring %v passes %v twice", test.name, ring, corner)
+				}
+				seen[corner] = true
+			}
+			if ringArea(ring) > 0 {
+				outers++
+			} else {
+				holes++
+			}
+			area += ringArea(ring)
+		}
+		if outers != test.outers || holes != test.holes {
+			t.Errorf("%s: %d outlines and %d holes, want %d and %d", test.name, outers, holes, test.outers, test.holes)
+		}
+		if area != 2*len(cells) {
+			t.Errorf("%s: rings cover %d squares, want %d", test.name, area/2, len(cells))
+		}
+	}
+}
+
+func TestBand(t *testing.T) {
+	grid := &reachGrid{latStep: 1, lngStep: 1, seconds: map[[2]int]int{}}
+	for cell := range testCells("#####", "#...#", "#.#.#", "#...#", "#####") {
+		grid.seconds[cell] = 600
+	}
+	grid.seconds[[2]int{2, 2}] = 60
+
+	if polygons := grid.band(30); len(polygons) != 0 {
+		t.Errorf("band(30) = %v, want nothing", polygons)
+	}
+	if polygons := grid.band(60); len(polygons) != 1 || len(polygons[0]) != 1 || len(polygons[0][0]) != 5 {
+		t.Errorf("band(60) = %v, want one square", polygons)
+	}
+
+	polygons := grid.band(600)
+	if len(polygons) != 2 {
+		t.Fatalf("band(600) has %d polygons, want 2", len(polygons))
+	}
+	rings := []int{len(polygons[0]), len(polygons[1])}
+	if !(rings[0] == 2 && rings[1] == 1 || rings[0] == 1 && rings[1] == 2) {
+		t.Errorf("band(600) polygons have %v rings, want the hole in the outer one", rings)
+	}
+	for _, polygon := range polygons {
+		for _, ring := range polygon {
+			if first, last := ring[0], ring[len(ring)-1]; first[0] != last[0] || first[1] != last[1] {
+				t.Errorf("ring %v is not closed", ring)
+			}
+		}
+	}
+}
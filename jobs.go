@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States a load job moves through.
+const (
+	jobQueued      = "queued"
+	jobDownloading = "downloading"
+	jobImporting   = "importing"
+	jobIndexing    = "indexing"
+	jobDone        = "done"
+	jobFailed      = "failed"
+)
+
+const (
+	// maxQueuedJobs is how many loads may wait behind the running one
+	// before further reloads are rejected.
+	maxQueuedJobs = 4
+	// maxJobHistory is how many jobs are remembered.
+	maxJobHistory = 100
+)
+
+var errQueueFull = errors.New("too many loads queued, try again later")
+
+// FileProgress records the import of one file of a feed.
+type FileProgress struct {
+	File       string    `json:"file"`
+	Rows       int       `json:"rows"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// LoadJob is one load of a feed, from being queued to done or failed.
+type LoadJob struct {
+	Id         string         `json:"id"`
+	FeedId     string         `json:"feed_id"`
+	Source     string         `json:"source"`
+	State      string         `json:"state"`
+	QueuedAt   time.Time      `json:"queued_at"`
+	StartedAt  *time.Time     `json:"started_at,omitempty"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Files      []FileProgress `json:"files"`
+	Rows       int            `json:"rows"`
+	Error      string         `json:"error,omitempty"`
+
+	open func() (*gtfsFeed, error)
+}
+
+// jobs is the registry of load jobs. Jobs are only changed under its
+// lock, and are copied out of it before being served.
+var jobs = struct {
+	sync.Mutex
+	byId  map[string]*LoadJob
+	order []*LoadJob
+	next  int
+	queue chan *LoadJob
+}{
+	byId:  map[string]*LoadJob{},
+	queue: make(chan *LoadJob, maxQueuedJobs),
+}
+
+// newLoadJob registers a queued job that loads the feed returned by open
+// under feedId.
+func newLoadJob(feedId string, source string, open func() (*gtfsFeed, error)) *LoadJob {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	jobs.next++
+	job := &LoadJob{
+		Id:       fmt.Sprintf("%d-%d", time.Now().Unix(), jobs.next),
+		FeedId:   feedId,
+		Source:   source,
+		State:    jobQueued,
+		QueuedAt: time.Now(),
+		Files:    []FileProgress{},
+		open:     open,
+	}
+
+	jobs.byId[job.Id] = job
+	jobs.order = append(jobs.order, job)
+	if len(jobs.order) > maxJobHistory {
+		delete(jobs.byId, jobs.order[0].Id)
+		jobs.order = jobs.order[1:]
+	}
+
+	return job
+}
+
+// enqueueLoad queues a load behind any running one. Loads never run in
+// parallel; when the queue is full the job fails straight away.
+func enqueueLoad(feedId string, source string, open func() (*gtfsFeed, error)) (*LoadJob, error) {
+	job := newLoadJob(feedId, source, open)
+
+	select {
+	case jobs.queue <- job:
+		log.Println("Queued load", job.Id, "of feed", feedId, "from", source)
+		return job, nil
+	default:
+		job.finish(errQueueFull)
+		return job, errQueueFull
+	}
+}
+
+// runLoadJobs runs queued jobs one at a time, forever.
+func runLoadJobs() {
+	for job := range jobs.queue {
+		job.run()
+	}
+}
+
+// run opens and loads the feed of the job, recording how it went. A
+// panic while loading fails the job rather than the server.
+func (job *LoadJob) run() {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Println("Loading feed", job.FeedId, "from", job.Source, "panicked. Previous feed kept.", rec)
+			log.Printf("%s", debug.Stack())
+			job.finish(fmt.Errorf("load failed: %v", rec))
+		}
+	}()
+
+	job.update(func() {
+		now := time.Now()
+		job.StartedAt = &now
+		if strings.HasPrefix(job.Source, "http://") || strings.HasPrefix(job.Source, "https://") {
+			job.State = jobDownloading
+		}
+	})
+
+	feed, err := job.open()
+	if err != nil {
+		log.Println("Opening", job.Source, "failed. Abort load.", err)
+		job.finish(err)
+		return
+	}
+
+	err = loadFeed(job, feed)
+	if err != nil {
+		log.Println("Loading feed", job.FeedId, "from", job.Source, "failed. Previous feed kept.", err)
+	}
+	job.finish(err)
+}
+
+// update changes the job under the registry lock.
+func (job *LoadJob) update(change func()) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	change()
+}
+
+func (job *LoadJob) setState(state string) {
+	job.update(func() { job.State = state })
+}
+
+// startFile records that a file has started importing.
+func (job *LoadJob) startFile(name string) {
+	job.update(func() {
+		job.State = jobImporting
+		job.Files = append(job.Files, FileProgress{File: name, StartedAt: time.Now()})
+	})
+}
+
+// finishFile records the row count of the file being imported.
+func (job *LoadJob) finishFile(rows int) {
+	job.update(func() {
+		file := &job.Files[len(job.Files)-1]
+		file.Rows = rows
+		file.DurationMs = int64(time.Since(file.StartedAt) / time.Millisecond)
+		job.Rows += rows
+	})
+}
+
+// finish marks the job done, or failed with err.
+func (job *LoadJob) finish(err error) {
+	job.update(func() {
+		now := time.Now()
+		job.FinishedAt = &now
+		job.State = jobDone
+		if err != nil {
+			job.State = jobFailed
+			job.Error = err.Error()
+		}
+	})
+}
+
+// snapshot copies the job so it can be served while it is still running.
+func (job *LoadJob) snapshot() LoadJob {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	copied := *job
+	copied.Files = append([]FileProgress{}, job.Files...)
+	return copied
+}
+
+// listJobs returns every remembered job, newest first.
+func listJobs() []LoadJob {
+	jobs.Lock()
+	order := append([]*LoadJob{}, jobs.order...)
+	jobs.Unlock()
+
+	list := make([]LoadJob, 0, len(order))
+	for i := len(order) - 1; i >= 0; i-- {
+		list = append(list, order[i].snapshot())
+	}
+	return list
+}
+
+func findJob(id string) (*LoadJob, bool) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	job, ok := jobs.byId[id]
+	return job, ok
+}
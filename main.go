@@ -1,41 +1,55 @@
 package main
 
 import (
-	"archive/zip"
 	"database/sql"
-	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
 	"os"
-	"path"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fromkeith/gorest"
 	_ "github.com/lib/pq"
 	"github.com/paulmach/go.geo"
-	"github.com/paulmach/go.geo/reducers"
+	"github.com/paulmach/go.geojson"
 	"gopkg.in/gorp.v1"
 )
 
 var dbMap *gorp.DbMap
 
+// defaultFeed is the feed ID used when a load does not name one.
+const defaultFeed = "default"
+
+// Feed records a GTFS feed loaded under its own feed ID.
+type Feed struct {
+	FeedId   string    `json:"feed_id"`
+	Source   string    `json:"source"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
 type Trip struct {
+	FeedId       string `json:"feed_id"`
 	RouteId      string `json:"route_id"`
 	ServiceId    string `json:"service_id"`
 	TripId       string `json:"trip_id"`
 	TripHeadsign string `json:"trip_headsign"`
-	DirectionId  string `json:"direction_id"`
+	DirectionId  int    `json:"direction_id,string"`
 	BlockId      string `json:"block_id"`
 	ShapeId      string `json:"shape_id"`
 }
 
 type Agency struct {
+	FeedId         string `json:"feed_id"`
+	AgencyId       string `json:"agency_id"`
 	AgencyName     string `json:"agency_name"`
 	AgencyUrl      string `json:"agency_url"`
 	AgencyTimezone string `json:"agency_timezone"`
@@ -44,56 +58,85 @@ type Agency struct {
 }
 
 type Calendar struct {
-	ServiceId string `json:"service_id"`
-	Monday    string `json:"monday"`
-	Tuesday   string `json:"tuesday"`
-	Wednesday string `json:"wednesday"`
-	Thursday  string `json:"thursday"`
-	Friday    string `json:"friday"`
-	Saturday  string `json:"saturday"`
-	Sunday    string `json:"sunday"`
-	StartDate string `json:"start_date"`
-	EndDate   string `json:"end_date"`
+	FeedId    string   `json:"feed_id"`
+	ServiceId string   `json:"service_id"`
+	Monday    string   `json:"monday"`
+	Tuesday   string   `json:"tuesday"`
+	Wednesday string   `json:"wednesday"`
+	Thursday  string   `json:"thursday"`
+	Friday    string   `json:"friday"`
+	Saturday  string   `json:"saturday"`
+	Sunday    string   `json:"sunday"`
+	StartDate GtfsDate `json:"start_date"`
+	EndDate   GtfsDate `json:"end_date"`
 }
 
 type CalendarDate struct {
-	ServiceId     string `json:"service_id"`
-	Date          string `json:"date"`
-	ExceptionType string `json:"exception_type"`
+	FeedId        string   `json:"feed_id"`
+	ServiceId     string   `json:"service_id"`
+	Date          GtfsDate `json:"date"`
+	ExceptionType int      `json:"exception_type,string"`
 }
 
 type Route struct {
+	FeedId         string `json:"feed_id"`
 	RouteId        string `json:"route_id"`
+	AgencyId       string `json:"agency_id"`
 	RouteShortName string `json:"route_short_name"`
 	RouteLongName  string `json:"route_long_name"`
 	RouteDesc      string `json:"route_desc"`
 	RouteType      string `json:"route_type"`
 	RouteUrl       string `json:"route_url"`
+	RouteColor     string `json:"route_color"`
+	RouteTextColor string `json:"route_text_color"`
 }
 
 type Shape struct {
+	FeedId          string  `json:"feed_id"`
 	ShapeId         string  `json:"shape_id"`
 	ShapePtLat      float64 `json:"shape_pt_lat"`
 	ShapePtLon      float64 `json:"shape_pt_lon"`
 	ShapePtSequence int     `json:"shape_pt_sequence"`
 }
 
+// ShapePath is one shape in the encoding a request asked for: Path
+// holds a polyline or hex WKB, Geometry a GeoJSON line and Coordinates
+// the bare lng/lat pairs.
 type ShapePath struct {
-	ShapeId string `json:"shape_id"`
-	Path    string `json:"path"`
+	FeedId      string            `json:"feed_id"`
+	ShapeId     string            `json:"shape_id"`
+	Path        string            `json:"path,omitempty"`
+	Geometry    *geojson.Geometry `json:"geometry,omitempty"`
+	Coordinates [][]float64       `json:"coordinates,omitempty"`
 }
 
 type StopTime struct {
-	TripId        string `json:"trip_id"`
-	ArrivalTime   string `json:"arrival_time"`
-	DepartureTime string `json:"departure_time"`
-	StopId        string `json:"stop_id"`
-	StopSequence  string `json:"stop_sequence"`
-	PickupType    string `json:"pickup_type"`
-	DropOffType   string `json:"drop_off_type"`
+	FeedId        string   `json:"feed_id"`
+	TripId        string   `json:"trip_id"`
+	ArrivalTime   GtfsTime `json:"arrival_time"`
+	DepartureTime GtfsTime `json:"departure_time"`
+	StopId        string   `json:"stop_id"`
+	StopSequence  int      `json:"stop_sequence"`
+	PickupType    string   `json:"pickup_type"`
+	DropOffType   string   `json:"drop_off_type"`
+
+	// ServiceDate, ArrivesAt and DepartsAt place the stop time on a
+	// particular service day, for schedules that span days.
+	ServiceDate *GtfsDate  `json:"service_date,omitempty" db:"-"`
+	ArrivesAt   *time.Time `json:"arrives_at,omitempty" db:"-"`
+	DepartsAt   *time.Time `json:"departs_at,omitempty" db:"-"`
+
+	// PredictedArrival, PredictedDeparture, Delay and
+	// ScheduleRelationship overlay GTFS-Realtime TripUpdates on a placed
+	// stop time. Delay is in seconds.
+	PredictedArrival     *time.Time `json:"predicted_arrival,omitempty" db:"-"`
+	PredictedDeparture   *time.Time `json:"predicted_departure,omitempty" db:"-"`
+	Delay                *int       `json:"delay,omitempty" db:"-"`
+	ScheduleRelationship string     `json:"schedule_relationship,omitempty" db:"-"`
 }
 
 type Stop struct {
+	FeedId       string  `json:"feed_id"`
 	StopId       string  `json:"stop_id"`
 	StopCode     string  `json:"stop_code"`
 	StopName     string  `json:"stop_name"`
@@ -102,21 +145,148 @@ type Stop struct {
 	StopLon      float64 `json:"stop_lon"`
 	ZoneId       string  `json:"zone_id"`
 	StopUrl      string  `json:"stop_url"`
-	LocationType string  `json:"location_type"`
+	LocationType int     `json:"location_type,string"`
+	StopTimezone string  `json:"stop_timezone"`
+}
+
+type Frequency struct {
+	FeedId      string   `json:"feed_id"`
+	TripId      string   `json:"trip_id"`
+	StartTime   GtfsTime `json:"start_time"`
+	EndTime     GtfsTime `json:"end_time"`
+	HeadwaySecs int      `json:"headway_secs"`
+	ExactTimes  string   `json:"exact_times"`
+}
+
+type Transfer struct {
+	FeedId          string `json:"feed_id"`
+	FromStopId      string `json:"from_stop_id"`
+	ToStopId        string `json:"to_stop_id"`
+	FromRouteId     string `json:"from_route_id"`
+	ToRouteId       string `json:"to_route_id"`
+	FromTripId      string `json:"from_trip_id"`
+	ToTripId        string `json:"to_trip_id"`
+	TransferType    string `json:"transfer_type"`
+	MinTransferTime int    `json:"min_transfer_time"`
+}
+
+type FeedInfo struct {
+	FeedId            string `json:"feed_id"`
+	FeedPublisherName string `json:"feed_publisher_name"`
+	FeedPublisherUrl  string `json:"feed_publisher_url"`
+	FeedLang          string `json:"feed_lang"`
+	DefaultLang       string `json:"default_lang"`
+	FeedStartDate     string `json:"feed_start_date"`
+	FeedEndDate       string `json:"feed_end_date"`
+	FeedVersion       string `json:"feed_version"`
+	FeedContactEmail  string `json:"feed_contact_email"`
+	FeedContactUrl    string `json:"feed_contact_url"`
+}
+
+type FareAttribute struct {
+	FeedId           string  `json:"feed_id"`
+	FareId           string  `json:"fare_id"`
+	Price            float64 `json:"price"`
+	CurrencyType     string  `json:"currency_type"`
+	PaymentMethod    string  `json:"payment_method"`
+	Transfers        string  `json:"transfers"`
+	AgencyId         string  `json:"agency_id"`
+	TransferDuration int     `json:"transfer_duration"`
+}
+
+type FareRule struct {
+	FeedId        string `json:"feed_id"`
+	FareId        string `json:"fare_id"`
+	RouteId       string `json:"route_id"`
+	OriginId      string `json:"origin_id"`
+	DestinationId string `json:"destination_id"`
+	ContainsId    string `json:"contains_id"`
+}
+
+type Level struct {
+	FeedId     string  `json:"feed_id"`
+	LevelId    string  `json:"level_id"`
+	LevelIndex float64 `json:"level_index"`
+	LevelName  string  `json:"level_name"`
+}
+
+type Pathway struct {
+	FeedId               string  `json:"feed_id"`
+	PathwayId            string  `json:"pathway_id"`
+	FromStopId           string  `json:"from_stop_id"`
+	ToStopId             string  `json:"to_stop_id"`
+	PathwayMode          string  `json:"pathway_mode"`
+	IsBidirectional      string  `json:"is_bidirectional"`
+	Length               float64 `json:"length"`
+	TraversalTime        int     `json:"traversal_time"`
+	StairCount           int     `json:"stair_count"`
+	MaxSlope             float64 `json:"max_slope"`
+	MinWidth             float64 `json:"min_width"`
+	SignpostedAs         string  `json:"signposted_as"`
+	ReversedSignpostedAs string  `json:"reversed_signposted_as"`
+}
+
+type Attribution struct {
+	FeedId           string `json:"feed_id"`
+	AttributionId    string `json:"attribution_id"`
+	AgencyId         string `json:"agency_id"`
+	RouteId          string `json:"route_id"`
+	TripId           string `json:"trip_id"`
+	OrganizationName string `json:"organization_name"`
+	IsProducer       string `json:"is_producer"`
+	IsOperator       string `json:"is_operator"`
+	IsAuthority      string `json:"is_authority"`
+	AttributionUrl   string `json:"attribution_url"`
+	AttributionEmail string `json:"attribution_email"`
+	AttributionPhone string `json:"attribution_phone"`
+}
+
+type Translation struct {
+	FeedId      string `json:"feed_id"`
+	TableName   string `json:"table_name"`
+	FieldName   string `json:"field_name"`
+	Language    string `json:"language"`
+	Translation string `json:"translation"`
+	RecordId    string `json:"record_id"`
+	RecordSubId string `json:"record_sub_id"`
+	FieldValue  string `json:"field_value"`
 }
 
 func main() {
 
-	wipePtr := flag.Bool("wipe", false, "wipe the database and reload it")
+	wipePtr := flag.Bool("wipe", false, "wipe the database before starting")
+	feedPtr := flag.String("feed", "", "GTFS feed to load at startup: a URL, zip file or directory of .txt files")
+	feedIdPtr := flag.String("feedId", defaultFeed, "feed ID to load the startup feed under")
+	validatePtr := flag.Bool("validate", false, "validate the feed given by -feed, print the report and exit")
+	realtimePtr := flag.String("realtime", "", "GTFS-Realtime TripUpdates to poll for the -feedId feed: a URL or file")
+	realtimeIntervalPtr := flag.Duration("realtimeInterval", defaultRealtimeInterval, "how often to poll the -realtime source")
 	flag.Parse()
 
+	if *realtimePtr != "" && *realtimeIntervalPtr < minRealtimeInterval {
+		log.Fatalf("-realtimeInterval %v is below the minimum of %v", *realtimeIntervalPtr, minRealtimeInterval)
+	}
+
+	if *validatePtr {
+		os.Exit(validateOnly(*feedIdPtr, *feedPtr))
+	}
+
 	var wipe bool = *wipePtr
 
 	dbMap = initDb(wipe)
 	defer dbMap.Db.Close()
 
-	if wipe {
-		load("8")
+	dropStaleStaging()
+
+	if *feedPtr != "" {
+		load(*feedIdPtr, *feedPtr)
+	}
+
+	go runLoadJobs()
+
+	if *realtimePtr != "" {
+		if err := watchRealtime(*feedIdPtr, *realtimePtr, *realtimeIntervalPtr); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	gorest.RegisterService(new(TransitService))
@@ -140,16 +310,12 @@ func initDb(wipe bool) *gorp.DbMap {
 	log.Println(db)
 
 	// construct a gorp DbMap
-	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
+	dbmap := &gorp.DbMap{Db: db, Dialect: tamerDialect{}}
 
-	dbmap.AddTableWithName(Trip{}, "trip")
-	dbmap.AddTableWithName(Agency{}, "agency")
-	dbmap.AddTableWithName(Calendar{}, "calendar")
-	dbmap.AddTableWithName(CalendarDate{}, "calendarDate")
-	dbmap.AddTableWithName(Route{}, "route")
-	dbmap.AddTableWithName(Shape{}, "shape")
-	dbmap.AddTableWithName(StopTime{}, "stopTime")
-	dbmap.AddTableWithName(Stop{}, "stop")
+	dbmap.AddTableWithName(Feed{}, "feed")
+	for _, table := range feedTables {
+		dbmap.AddTableWithName(table.row, table.name)
+	}
 
 	// create the table. in a production system you'd generally
 	// use a migration tool, or create the tables via scripts
@@ -160,248 +326,443 @@ func initDb(wipe bool) *gorp.DbMap {
 	err = dbmap.CreateTablesIfNotExists()
 	checkErr(err, "Creating tables")
 
+	err = addMissingColumns(dbmap)
+	checkErr(err, "Adding columns")
+
+	err = convertColumns(dbmap)
+	checkErr(err, "Converting columns")
+
+	createIndexes(dbmap)
+
 	return dbmap
 }
 
+// feedTables lists the tables holding the rows of each loaded feed.
+var feedTables = []struct {
+	row  interface{}
+	name string
+}{
+	{Trip{}, "trip"},
+	{Agency{}, "agency"},
+	{Calendar{}, "calendar"},
+	{CalendarDate{}, "calendarDate"},
+	{Route{}, "route"},
+	{Shape{}, "shape"},
+	{StopTime{}, "stopTime"},
+	{Stop{}, "stop"},
+	{Frequency{}, "frequency"},
+	{Transfer{}, "transfer"},
+	{FeedInfo{}, "feedInfo"},
+	{FareAttribute{}, "fareAttribute"},
+	{FareRule{}, "fareRule"},
+	{Level{}, "level"},
+	{Pathway{}, "pathway"},
+	{Attribution{}, "attribution"},
+	{Translation{}, "translation"},
+	{Pattern{}, "pattern"},
+	{PatternStop{}, "patternStop"},
+}
+
+// addMissingColumns brings tables created by an older build up to date
+// with their structs, since CreateTablesIfNotExists leaves them alone.
+func addMissingColumns(dbmap *gorp.DbMap) error {
+	for _, table := range feedTables {
+		t := reflect.TypeOf(table.row)
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).Tag.Get("db") == "-" {
+				continue
+			}
+			column := strings.ToLower(t.Field(i).Name)
+			sqlType := dbmap.Dialect.ToSqlType(t.Field(i).Type, 0, false)
+
+			_, err := dbmap.Exec(fmt.Sprintf("alter table %s add column if not exists %s %s",
+				strings.ToLower(table.name), column, sqlType))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// convertColumns retypes the columns that older builds stored as text,
+// parsing the values already loaded. Times and dates that don't parse
+// become NULL, integers 0.
+func convertColumns(dbmap *gorp.DbMap) error {
+	for _, table := range feedTables {
+		name := strings.ToLower(table.name)
+		t := reflect.TypeOf(table.row)
+		for i := 0; i < t.NumField(); i++ {
+			conversion, ok := columnConversions[t.Field(i).Type]
+			if !ok || t.Field(i).Tag.Get("db") == "-" {
+				continue
+			}
+			column := strings.ToLower(t.Field(i).Name)
+
+			current, err := dbmap.SelectStr("select data_type from information_schema.columns "+
+				"where table_schema = 'public' and table_name = $1 and column_name = $2", name, column)
+			if err != nil {
+				return err
+			}
+			if current != "text" {
+				continue
+			}
+
+			log.Println("Converting", name+"."+column)
+			sqlType := dbmap.Dialect.ToSqlType(t.Field(i).Type, 0, false)
+			_, err = dbmap.Exec(fmt.Sprintf("alter table %s alter column %s type %s using %s",
+				name, column, sqlType, fmt.Sprintf(conversion, column)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func createIndexes(dbmap *gorp.DbMap) {
+	log.Println("Generating Indexes")
+
+	dbmap.Exec("create index if not exists stoptime_stopid on stoptime (stopid)")
+	dbmap.Exec("create index if not exists stoptime_tripid on stoptime (tripid)")
+	dbmap.Exec("create index if not exists stoptime_feedid on stoptime (feedid)")
+	dbmap.Exec("create index if not exists trip_serviceid on trip (serviceid)")
+	dbmap.Exec("create index if not exists trip_tripid on trip (tripid)")
+	dbmap.Exec("create index if not exists trip_routeid on trip (routeid)")
+	dbmap.Exec("create index if not exists trip_feedid on trip (feedid)")
+	dbmap.Exec("create index if not exists shape_shapeid on shape (shapeid)")
+	dbmap.Exec("create index if not exists shape_feedid on shape (feedid)")
+	dbmap.Exec("create index if not exists frequency_tripid on frequency (tripid)")
+	dbmap.Exec("create index if not exists transfer_fromstopid on transfer (fromstopid)")
+	dbmap.Exec("create index if not exists pattern_routeid on pattern (routeid)")
+	dbmap.Exec("create index if not exists patternstop_patternid on patternstop (patternid)")
+}
+
 func checkErr(err error, msg string) {
 	if err != nil {
 		log.Fatalln(msg, err)
 	}
 }
 
-func downloadDataset(url string, output string) {
-	log.Println("Downloading", url, "to", output)
-
-	outfile, err := os.Create(output)
+func downloadDataset(url string) (string, error) {
+	outfile, err := ioutil.TempFile("", "tamer-schedules-")
 	if err != nil {
-		log.Println("Error creating", output, "-", err)
-		return
+		return "", err
 	}
 	defer outfile.Close()
 
+	log.Println("Downloading", url, "to", outfile.Name())
+
 	response, err := http.Get(url)
 	if err != nil {
-		log.Println("Error while downloading", url, "-", err)
-		return
+		os.Remove(outfile.Name())
+		return "", err
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode != http.StatusOK {
+		os.Remove(outfile.Name())
+		return "", fmt.Errorf("downloading %s: %s", url, response.Status)
+	}
+
 	n, err := io.Copy(outfile, response.Body)
 	if err != nil {
-		log.Println("error wile downloading", url, "-", err)
-		return
+		os.Remove(outfile.Name())
+		return "", err
 	}
 
 	log.Println(n, "bytes downloaded.")
+	return outfile.Name(), nil
+}
+
+// load imports a GTFS feed from a URL, a zip file or a directory
+// under the given feed ID, as a tracked job run right away.
+func load(feedId string, source string) *LoadJob {
+	job := newLoadJob(feedId, source, func() (*gtfsFeed, error) {
+		return openFeed(source)
+	})
+	job.run()
+	return job
 }
 
-func load(artifactId string) {
-	// Download the most recent dataset
-	url := fmt.Sprintf("%s", artifactId)
-	downloadDataset(url, "/tmp/schedules.zip")
-	// delete any existing rows
-	err := dbMap.TruncateTables()
-	checkErr(err, "TruncateTables failed")
+// loadFeed imports a feed into a staging schema, checks and indexes it,
+// and only then swaps it in for the live rows of the feed. Every other
+// feed is left alone, and on failure the live rows are untouched. The
+// progress of the load is recorded on job.
+func loadFeed(job *LoadJob, feed *gtfsFeed) error {
+	defer feed.Close()
 
-	dbMap.Exec("drop index stoptime_stopid")
-	dbMap.Exec("drop index stoptime_tripid")
-	dbMap.Exec("drop index trip_serviceid")
-	dbMap.Exec("drop index trip_tripid")
-	dbMap.Exec("drop index trip_routeid")
+	feedId := job.FeedId
+	job.setState(jobImporting)
 
-	r, err := zip.OpenReader("/tmp/schedules.zip")
+	staging, err := newStagingArea()
 	if err != nil {
-		log.Printf("Zip opening failed. Abort load.")
-		return
+		return err
 	}
-	defer r.Close()
+	defer staging.drop()
+
+	validator := newFeedValidator(feedId, job.Source)
+
+	// Iterate through the files in the feed,
+	// importing the ones we know about.
+	for _, f := range feed.files {
+		spec, known := gtfsFiles[f.name]
+		if !known {
+			log.Printf("Skipping unsupported file %s", f.name)
+			validator.unsupported(f.name)
+			continue
+		}
 
-	// Iterate through the files in the archive,
-	// printing some of their contents.
-	for _, f := range r.File {
-		log.Printf("Processing %s...", f.Name)
-		rc, err := f.Open()
+		log.Printf("Processing %s for feed %s...", f.name, feedId)
+		rc, err := f.open()
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
-		fileName := path.Base(f.Name)
-
-		transaction, dbMapErr := dbMap.Begin()
-		checkErr(dbMapErr, "Starting Transaction")
-
-		reader := csv.NewReader(rc)
-		reader.FieldsPerRecord = -1
-		rawCSVdata, err := reader.ReadAll()
+		started := time.Now()
+		job.startFile(f.name)
+		rows, err := importFile(staging, validator, feedId, f.name, spec, rc)
+		rc.Close()
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("importing %s: %v", f.name, err)
 		}
 
-		records := 0
+		job.finishFile(rows)
+		elapsed := time.Since(started)
+		log.Printf("Imported %d rows from %s in %v (%.0f rows/s)", rows, f.name, elapsed, float64(rows)/elapsed.Seconds())
+	}
 
-		for i := 1; i < len(rawCSVdata); i++ {
+	report := validator.finish()
+	saveReport(report)
+	if !report.Valid() {
+		return fmt.Errorf("feed has %d validation errors, first: %s line %d: %s",
+			report.ErrorCount, report.Errors[0].File, report.Errors[0].Line, report.Errors[0].Message)
+	}
 
-			records++
+	job.setState(jobIndexing)
+	if err := staging.index(); err != nil {
+		return err
+	}
+	if err := staging.validate(); err != nil {
+		return err
+	}
+	if err := staging.derivePatterns(); err != nil {
+		return err
+	}
+	if err := staging.promote(feedId, job.Source); err != nil {
+		return err
+	}
+	forgetFeed(feedId)
+	if _, err := stopIndexFor(feedId); err != nil {
+		log.Println("Indexing the stops of feed", feedId, "failed.", err)
+	}
 
-			if records > 15000 {
-				checkErr(transaction.Commit(), "Commiting Transaction")
-				transaction, dbMapErr = dbMap.Begin()
-				checkErr(dbMapErr, "Starting Transaction")
-				records = 0
-			}
+	log.Println("Finished.")
+	return nil
+}
 
-			switch fileName {
-			case "trips.txt":
-				trip := Trip{
-					RouteId:      rawCSVdata[i][0],
-					ServiceId:    rawCSVdata[i][1],
-					TripId:       rawCSVdata[i][2],
-					TripHeadsign: rawCSVdata[i][3],
-					DirectionId:  rawCSVdata[i][4],
-					BlockId:      rawCSVdata[i][5],
-					ShapeId:      rawCSVdata[i][6],
-				}
-				err := transaction.Insert(&trip)
-				checkErr(err, "Inserting record")
-			case "agency.txt":
-				agency := Agency{
-					AgencyName:     rawCSVdata[i][0],
-					AgencyUrl:      rawCSVdata[i][1],
-					AgencyTimezone: rawCSVdata[i][2],
-					AgencyLang:     rawCSVdata[i][3],
-					AgencyPhone:    rawCSVdata[i][4],
-				}
-				err := transaction.Insert(&agency)
-				checkErr(err, "Inserting record")
-			case "calendar.txt":
-				calendar := Calendar{
-					ServiceId: rawCSVdata[i][0],
-					Monday:    rawCSVdata[i][1],
-					Tuesday:   rawCSVdata[i][2],
-					Wednesday: rawCSVdata[i][3],
-					Thursday:  rawCSVdata[i][4],
-					Friday:    rawCSVdata[i][5],
-					Saturday:  rawCSVdata[i][6],
-					Sunday:    rawCSVdata[i][7],
-					StartDate: rawCSVdata[i][8],
-					EndDate:   rawCSVdata[i][9],
-				}
-				err := transaction.Insert(&calendar)
-				checkErr(err, "Inserting record")
-			case "calendar_dates.txt":
-				calendarDate := CalendarDate{
-					ServiceId:     rawCSVdata[i][0],
-					Date:          rawCSVdata[i][1],
-					ExceptionType: rawCSVdata[i][2],
-				}
-				err := transaction.Insert(&calendarDate)
-				checkErr(err, "Inserting record")
-			case "routes.txt":
-				route := Route{
-					RouteId:        rawCSVdata[i][0],
-					RouteShortName: rawCSVdata[i][1],
-					RouteLongName:  rawCSVdata[i][2],
-					RouteDesc:      rawCSVdata[i][3],
-					RouteType:      rawCSVdata[i][4],
-					RouteUrl:       rawCSVdata[i][5],
-				}
-				err := transaction.Insert(&route)
-				checkErr(err, "Inserting record")
-			case "shapes.txt":
-				lat, _ := strconv.ParseFloat(strings.TrimSpace(rawCSVdata[i][1]), 64)
-				lon, _ := strconv.ParseFloat(strings.TrimSpace(rawCSVdata[i][2]), 64)
-				seq, _ := strconv.Atoi(rawCSVdata[i][3])
-				shape := Shape{
-					ShapeId:         rawCSVdata[i][0],
-					ShapePtLat:      lat,
-					ShapePtLon:      lon,
-					ShapePtSequence: seq,
-				}
-				err := transaction.Insert(&shape)
-				checkErr(err, "Inserting record")
-			case "stop_times.txt":
-				stopTime := StopTime{
-					TripId:        rawCSVdata[i][0],
-					ArrivalTime:   rawCSVdata[i][1],
-					DepartureTime: rawCSVdata[i][2],
-					StopId:        rawCSVdata[i][3],
-					StopSequence:  rawCSVdata[i][4],
-					PickupType:    rawCSVdata[i][5],
-					DropOffType:   rawCSVdata[i][6],
-				}
-				err := transaction.Insert(&stopTime)
-				checkErr(err, "Inserting record")
-			case "stops.txt":
-				lat, _ := strconv.ParseFloat(strings.TrimSpace(rawCSVdata[i][4]), 64)
-				lon, _ := strconv.ParseFloat(strings.TrimSpace(rawCSVdata[i][5]), 64)
-				stop := Stop{
-					StopId:       rawCSVdata[i][0],
-					StopCode:     rawCSVdata[i][1],
-					StopName:     rawCSVdata[i][2],
-					StopDesc:     rawCSVdata[i][3],
-					StopLat:      lat,
-					StopLon:      lon,
-					ZoneId:       rawCSVdata[i][6],
-					StopUrl:      rawCSVdata[i][7],
-					LocationType: rawCSVdata[i][8],
-				}
-				err := transaction.Insert(&stop)
-				checkErr(err, "Inserting record")
-			}
+var (
+	generationsMutex sync.Mutex
+	// feedGenerations counts the reloads of each feed, and under "" of
+	// every feed, so that a cache filled from rows read before a reload
+	// can tell they are stale.
+	feedGenerations = map[string]int{}
+)
+
+// feedGeneration returns how many times a feed, or any feed for "", has
+// been reloaded. Caches read it before the rows they hold and store them
+// only if it is unchanged, checking under their own lock.
+func feedGeneration(feedId string) int {
+	generationsMutex.Lock()
+	defer generationsMutex.Unlock()
+	return feedGenerations[feedId]
+}
+
+// forgetFeed drops everything cached about a feed once it is reloaded.
+// The generation is bumped first, so rows read before the reload that
+// are stored after it are dropped too or never stored.
+func forgetFeed(feedId string) {
+	generationsMutex.Lock()
+	feedGenerations[feedId]++
+	feedGenerations[""]++
+	generationsMutex.Unlock()
+
+	forgetLocation(feedId)
+	forgetServices(feedId)
+	forgetStopIndex(feedId)
+	forgetTiles(feedId)
+	forgetTimetables(feedId)
+}
+
+type TransitService struct {
+	gorest.RestService  `root:"/tamer-v2/" consumes:"application/json" produces:"application/json"`
+	agency              gorest.EndPoint `method:"GET" path:"/agency?{feed:string}" output:"Agency"`
+	agencies            gorest.EndPoint `method:"GET" path:"/agencies?{feed:string}" output:"[]Agency"`
+	feeds               gorest.EndPoint `method:"GET" path:"/feeds" output:"[]Feed"`
+	findStop            gorest.EndPoint `method:"GET" path:"/findStop/{stopCode:string}?{feed:string}" output:"Stop"`
+	routes              gorest.EndPoint `method:"GET" path:"/routes/{stopCode:string}?{feed:string}&{date:string}" output:"[]Route"`
+	calendar            gorest.EndPoint `method:"GET" path:"/calendar?{feed:string}&{date:string}" output:"[]Calendar"`
+	calendars           gorest.EndPoint `method:"GET" path:"/calendars/{year:string}/{month:string}/{day:string}?{feed:string}" output:"[]Calendar"`
+	exceptions          gorest.EndPoint `method:"GET" path:"/exceptions/{date:string}?{feed:string}" output:"[]CalendarDate"`
+	service             gorest.EndPoint `method:"GET" path:"/service?{feed:string}&{date:string}" output:"[]string"`
+	allCalendars        gorest.EndPoint `method:"GET" path:"/calendars?{feed:string}" output:"[]Calendar"`
+	patterns            gorest.EndPoint `method:"GET" path:"/routes/{routeId:string}/patterns?{directionId:string}&{feed:string}" output:"[]Pattern"`
+	findRoute           gorest.EndPoint `method:"GET" path:"/findroute/{shortName:string}?{feed:string}" output:"[]Route"`
+	stopsForRoute       gorest.EndPoint `method:"GET" path:"/stops/{routeId:string}/{directionId:string}?{feed:string}&{date:string}&{format:string}&{order:string}" output:"[]Stop"`
+	nearestStops        gorest.EndPoint `method:"GET" path:"/stops/nearest?{lat:string}&{lon:string}&{k:string}&{maxDistance:string}&{routeType:string}&{feed:string}" output:"[]NearbyStop"`
+	stopsInRange        gorest.EndPoint `method:"GET" path:"/stops/{lon:string}/{lat:string}/{distance:string}?{feed:string}&{format:string}" output:"[]Stop"`
+	nearestStopForRoute gorest.EndPoint `method:"GET" path:"/stop/{routeId:string}/{directionId:string}/{lon:string}/{lat:string}?{feed:string}&{date:string}" output:"Stop"`
+	shape               gorest.EndPoint `method:"GET" path:"/shape/{routeId:string}/{directionId:string}?{feed:string}&{date:string}&{format:string}&{reducer:string}&{tolerance:string}&{encoding:string}" output:"[]ShapePath"`
+	shapeById           gorest.EndPoint `method:"GET" path:"/shape/{shapeId:string}?{feed:string}&{format:string}&{reducer:string}&{tolerance:string}&{encoding:string}" output:"[]ShapePath"`
+	network             gorest.EndPoint `method:"GET" path:"/network?{routeType:string}&{feed:string}&{date:string}&{format:string}" output:"[]RouteShapes"`
+	tile                gorest.EndPoint `method:"GET" path:"/tiles/{z:string}/{x:string}/{y:string}?{feed:string}" output:"string"`
+	stopSchedule        gorest.EndPoint `method:"GET" path:"/schedule/{stopId:string}/{routeId:string}?{feed:string}&{date:string}" output:"[]StopTime"`
+	tripSchedule        gorest.EndPoint `method:"GET" path:"/schedule/{tripId:string}?{feed:string}" output:"[]StopTime"`
+	trip                gorest.EndPoint `method:"GET" path:"/trip/{tripId:string}?{feed:string}" output:"[]Trip"`
+	departures          gorest.EndPoint `method:"GET" path:"/departures/{stopId:string}?{from:string}&{window:string}&{limit:string}&{feed:string}" output:"[]Departure"`
+	plan                gorest.EndPoint `method:"GET" path:"/plan?{from:string}&{to:string}&{time:string}&{arriveBy:string}&{maxWalk:string}&{maxTransfers:string}&{feed:string}" output:"[]Itinerary"`
+	isochrone           gorest.EndPoint `method:"GET" path:"/isochrone?{lat:string}&{lon:string}&{departAt:string}&{maxMinutes:string}&{bands:string}&{maxWalk:string}&{feed:string}&{format:string}" output:"Isochrone"`
+	scheduledVehicles   gorest.EndPoint `method:"GET" path:"/vehicles/scheduled?{routeId:string}&{at:string}&{feed:string}" output:"[]ScheduledVehicle"`
+	trips               gorest.EndPoint `method:"GET" path:"/trips/{routeId:string}?{feed:string}&{date:string}" output:"[]Trip"`
+	frequencies         gorest.EndPoint `method:"GET" path:"/frequencies/{tripId:string}?{feed:string}" output:"[]Frequency"`
+	transfers           gorest.EndPoint `method:"GET" path:"/transfers/{stopId:string}?{feed:string}" output:"[]Transfer"`
+	feedInfo            gorest.EndPoint `method:"GET" path:"/feedinfo?{feed:string}" output:"[]FeedInfo"`
+	fares               gorest.EndPoint `method:"GET" path:"/fares?{feed:string}" output:"[]FareAttribute"`
+	fareRules           gorest.EndPoint `method:"GET" path:"/fares/{fareId:string}?{feed:string}" output:"[]FareRule"`
+	levels              gorest.EndPoint `method:"GET" path:"/levels?{feed:string}" output:"[]Level"`
+	pathways            gorest.EndPoint `method:"GET" path:"/pathways/{stopId:string}?{feed:string}" output:"[]Pathway"`
+	attributions        gorest.EndPoint `method:"GET" path:"/attributions?{feed:string}" output:"[]Attribution"`
+	translations        gorest.EndPoint `method:"GET" path:"/translations/{language:string}?{feed:string}" output:"[]Translation"`
+	reload              gorest.EndPoint `method:"POST" path:"/admin/data/reload?{feed:string}" postdata:"string"`
+	validate            gorest.EndPoint `method:"POST" path:"/admin/data/validate?{feed:string}" postdata:"string"`
+	jobs                gorest.EndPoint `method:"GET" path:"/admin/data/jobs" output:"[]LoadJob"`
+	job                 gorest.EndPoint `method:"GET" path:"/admin/data/jobs/{id:string}" output:"LoadJob"`
+	validation          gorest.EndPoint `method:"GET" path:"/admin/data/validation?{feed:string}" output:"ValidationReport"`
+	pushRealtime        gorest.EndPoint `method:"POST" path:"/admin/realtime/tripupdates?{feed:string}" postdata:"string"`
+	pollRealtime        gorest.EndPoint `method:"POST" path:"/admin/realtime/source?{feed:string}&{interval:string}" postdata:"string"`
+	realtimeStatus      gorest.EndPoint `method:"GET" path:"/admin/realtime" output:"[]RealtimeStatus"`
+}
+
+// Reload queues a load of a feed posted as a zip, either raw or as a
+// multipart form, or else from the URL, zip file or directory named by
+// the body. Only the rows of the given feed, "default" if unset, are
+// replaced. The queued job is returned, to be followed at its Location.
+func (serv TransitService) Reload(source string, feed string) {
+	if feed == "" {
+		feed = defaultFeed
+	}
+
+	contentType := serv.Context.Request().Header.Get("Content-Type")
+
+	var job *LoadJob
+	var err error
+	if !isUpload(source, contentType) {
+		source = strings.TrimSpace(source)
+		job, err = enqueueLoad(feed, source, func() (*gtfsFeed, error) {
+			return openFeed(source)
+		})
+	} else {
+		zipPath, uploadErr := saveUpload(source, contentType)
+		if uploadErr != nil {
+			serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(uploadErr.Error()))
+			return
 		}
 
-		rc.Close()
-		fmt.Println()
+		job, err = enqueueLoad(feed, "upload", func() (*gtfsFeed, error) {
+			return openZipFeed(zipPath, true)
+		})
+		if err != nil {
+			os.Remove(zipPath)
+		}
+	}
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(503).WriteAndOveride([]byte(err.Error()))
+		return
+	}
 
-		transaction.Commit()
+	body, err := json.Marshal(job.snapshot())
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return
 	}
+	serv.ResponseBuilder().Location("/tamer-v2/admin/data/jobs/" + job.Id).SetResponseCode(202)
+	serv.ResponseBuilder().SetContentType("application/json").WriteAndOveride(body)
+}
 
-	log.Println("Generating Indexes")
+// Jobs lists the remembered load jobs, newest first.
+func (serv TransitService) Jobs() []LoadJob {
+	return listJobs()
+}
 
-	dbMap.Exec("create index stoptime_stopid on stoptime (stopid)")
-	dbMap.Exec("create index stoptime_tripid on stoptime (tripid)")
-	dbMap.Exec("create index trip_serviceid on trip (serviceid)")
-	dbMap.Exec("create index trip_tripid on trip (tripid)")
-	dbMap.Exec("create index trip_routeid on trip (routeid)")
+// Job returns one load job and its progress so far.
+func (serv TransitService) Job(id string) LoadJob {
+	job, ok := findJob(id)
+	if !ok {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte("no load job " + id))
+		return LoadJob{}
+	}
+	return job.snapshot()
+}
 
-	err = os.Remove("/tmp/schedules.zip")
-	checkErr(err, "deleting /tmp/schedules.zip")
+// Validate checks a feed, posted or named the same way as for Reload,
+// and responds with the validation report without loading anything.
+func (serv TransitService) Validate(source string, feed string) {
+	if feed == "" {
+		feed = defaultFeed
+	}
 
-	log.Println("Finished.")
+	contentType := serv.Context.Request().Header.Get("Content-Type")
+
+	var gtfs *gtfsFeed
+	var err error
+	if isUpload(source, contentType) {
+		var zipPath string
+		if zipPath, err = saveUpload(source, contentType); err == nil {
+			gtfs, err = openZipFeed(zipPath, true)
+		}
+	} else {
+		gtfs, err = openFeed(strings.TrimSpace(source))
+	}
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return
+	}
+	defer gtfs.Close()
+
+	report, err := validateFeed(feed, gtfs)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return
+	}
+	serv.ResponseBuilder().SetContentType("application/json").WriteAndOveride(body)
 }
 
-type TransitService struct {
-	gorest.RestService  `root:"/tamer-v2/" consumes:"application/json" produces:"application/json"`
-	agency              gorest.EndPoint `method:"GET" path:"/agency" output:"Agency"`
-	findStop            gorest.EndPoint `method:"GET" path:"/findStop/{stopCode:string}" output:"Stop"`
-	routes              gorest.EndPoint `method:"GET" path:"/routes/{stopCode:string}" output:"[]Route"`
-	calendar            gorest.EndPoint `method:"GET" path:"/calendar" output:"[]Calendar"`
-	calendars           gorest.EndPoint `method:"GET" path:"/calendars/{year:string}/{month:string}/{day:string}" output:"[]Calendar"`
-	exceptions          gorest.EndPoint `method:"GET" path:"/exceptions/{date:string}" output:"[]CalendarDate"`
-	service             gorest.EndPoint `method:"GET" path:"/service" output:"[]string"`
-	allCalendars        gorest.EndPoint `method:"GET" path:"/calendars" output:"[]Calendar"`
-	findRoute           gorest.EndPoint `method:"GET" path:"/findroute/{shortName:string}" output:"[]Route"`
-	stopsForRoute       gorest.EndPoint `method:"GET" path:"/stops/{routeId:string}/{directionId:string}" output:"[]Stop"`
-	stopsInRange        gorest.EndPoint `method:"GET" path:"/stops/{lon:string}/{lat:string}/{distance:string}" output:"[]Stop"`
-	nearestStopForRoute gorest.EndPoint `method:"GET" path:"/stop/{routeId:string}/{directionId:string}/{lon:string}/{lat:string}" output:"Stop"`
-	shape               gorest.EndPoint `method:"GET" path:"/shape/{routeId:string}/{directionId:string}" output:"[]ShapePath"`
-	shapeById           gorest.EndPoint `method:"GET" path:"/shape/{shapeId:string}" output:"[]ShapePath"`
-	stopSchedule        gorest.EndPoint `method:"GET" path:"/schedule/{stopId:string}/{routeId:string}" output:"[]StopTime"`
-	tripSchedule        gorest.EndPoint `method:"GET" path:"/schedule/{tripId:string}" output:"[]StopTime"`
-	trip                gorest.EndPoint `method:"GET" path:"/trip/{tripId:string}" output:"[]Trip"`
-	trips               gorest.EndPoint `method:"GET" path:"/trips/{routeId:string}" output:"[]Trip"`
-	reload              gorest.EndPoint `method:"POST" path:"/admin/data/reload" postdata:"string"`
-}
-
-func (serv TransitService) Reload(artifactId string) {
-	log.Println(artifactId)
-	go load(artifactId)
-}
-
-func (serv TransitService) Agency() Agency {
+// Validation returns the report of the last load of a feed.
+func (serv TransitService) Validation(feed string) ValidationReport {
+	if feed == "" {
+		feed = defaultFeed
+	}
+
+	report, ok := lastReport(feed)
+	if !ok {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte("no load of feed " + feed + " has been validated"))
+		return ValidationReport{}
+	}
+	return *report
+}
+
+func (serv TransitService) Agency(feed string) Agency {
 
 	var agency Agency
-	err := dbMap.SelectOne(&agency, "select * from agency")
+	err := dbMap.SelectOne(&agency, "select * from agency where (:feed = '' or feedid = :feed) order by feedid limit 1", map[string]interface{}{
+		"feed": feed,
+	})
 	if err != nil {
 		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
 	}
@@ -409,14 +770,11 @@ func (serv TransitService) Agency() Agency {
 	return agency
 }
 
-func (serv TransitService) TripSchedule(tripId string) []StopTime {
-	all := []StopTime{}
-
-	query := "select * from stoptime where tripid = :tripId " +
-		" order by arrivaltime"
+func (serv TransitService) Agencies(feed string) []Agency {
+	all := []Agency{}
 
-	_, err := dbMap.Select(&all, query, map[string]interface{}{
-		"tripId": tripId,
+	_, err := dbMap.Select(&all, "select * from agency where (:feed = '' or feedid = :feed) order by feedid, agencyname", map[string]interface{}{
+		"feed": feed,
 	})
 
 	if err != nil {
@@ -426,15 +784,10 @@ func (serv TransitService) TripSchedule(tripId string) []StopTime {
 	return all
 }
 
-func (serv TransitService) Trip(tripId string) []Trip {
-	all := []Trip{}
-
-	query := "select * from trip where tripid = :tripId " +
-		" order by tripid"
+func (serv TransitService) Feeds() []Feed {
+	all := []Feed{}
 
-	_, err := dbMap.Select(&all, query, map[string]interface{}{
-		"tripId": tripId,
-	})
+	_, err := dbMap.Select(&all, "select * from feed order by feedid")
 
 	if err != nil {
 		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
@@ -443,36 +796,39 @@ func (serv TransitService) Trip(tripId string) []Trip {
 	return all
 }
 
-func (serv TransitService) Trips(routeId string) []Trip {
-	all := []Trip{}
-
-	services := serv.currentServiceList()
+func (serv TransitService) TripSchedule(tripId string, feed string) []StopTime {
+	all := []StopTime{}
 
-	query := "select * from trip where serviceid in (" + services + ") and routeid = :routeId"
+	query := "select * from stoptime where tripid = :tripId and (:feed = '' or feedid = :feed) " +
+		" order by feedid, stopsequence"
 
 	_, err := dbMap.Select(&all, query, map[string]interface{}{
-		"routeId": routeId,
+		"tripId": tripId,
+		"feed":   feed,
 	})
 
 	if err != nil {
 		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+
+	placeUpdatedTrips(all)
+	if err := overlayRealtime(all); err != nil {
+		log.Println("Overlaying realtime on trip", tripId, "failed.", err)
 	}
 
 	return all
 }
 
-func (serv TransitService) StopSchedule(stopId string, routeId string) []StopTime {
-	all := []StopTime{}
-
-	services := serv.currentServiceList()
+func (serv TransitService) Trip(tripId string, feed string) []Trip {
+	all := []Trip{}
 
-	query := "select * from stoptime where tripid in " +
-		"(select tripid from trip where serviceid in (" + services + ") and routeid = :routeId ) " +
-		"and stopid = :stopId order by arrivaltime"
+	query := "select * from trip where tripid = :tripId and (:feed = '' or feedid = :feed) " +
+		" order by tripid"
 
 	_, err := dbMap.Select(&all, query, map[string]interface{}{
-		"routeId": routeId,
-		"stopId":  stopId,
+		"tripId": tripId,
+		"feed":   feed,
 	})
 
 	if err != nil {
@@ -482,197 +838,307 @@ func (serv TransitService) StopSchedule(stopId string, routeId string) []StopTim
 	return all
 }
 
-func (serv TransitService) Shape(routeId string, directionId string) []ShapePath {
-	all := []ShapePath{}
+func (serv TransitService) Trips(routeId string, feed string, date string) []Trip {
+	all := []Trip{}
 
-	services := serv.currentServiceList()
+	day, err := parseServiceDate(date)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
 
-	query := "select * from shape where shapeid in " +
-		"(select shapeid from trip where routeid = :route and directionid = :direction and serviceid in (" + services + ")) " +
-		"order by shapeid, shapeptsequence"
+	services, err := serv.activeServices(feed, day)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
 
-	shapes := []Shape{}
+	query := "select * from trip where (feedid, serviceid) in " + activeServiceSQL + " and routeid = :routeId"
+
+	_, err = dbMap.Select(&all, query, services.bind(map[string]interface{}{
+		"routeId": routeId,
+	}))
 
-	_, err := dbMap.Select(&shapes, query, map[string]interface{}{
-		"route":     routeId,
-		"direction": directionId,
-	})
 	if err != nil {
 		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
 	}
 
-	var currentShape string
-	points := [][2]float64{}
+	return all
+}
 
-	for _, shape := range shapes {
-		if currentShape != shape.ShapeId {
+// StopSchedule lists the stop times of a route at a stop on a service
+// day, together with the trips of the day before that reach the stop
+// after midnight. Each carries the instants it arrives and departs,
+// which the list is ordered by.
+func (serv TransitService) StopSchedule(stopId string, routeId string, feed string, date string) []StopTime {
+	all := []StopTime{}
 
-			if len(points) > 0 {
-				path := geo.NewPathFromXYData(points)
+	day, err := parseServiceDate(date)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
 
-				reducedPath := reducers.DouglasPeucker(path, 1.0e-5)
-				encodedString := reducedPath.Encode()
-				all = append(all, ShapePath{
-					ShapeId: currentShape,
-					Path:    encodedString,
-				})
-			}
+	feedIds, err := feedIdsFor(feed)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
 
-			points = [][2]float64{}
-			currentShape = shape.ShapeId
+	for _, feedId := range feedIds {
+		today := serviceDayStart(day(feedLocation(feedId)))
+		yesterday := serviceDayStart(today.Add(-12 * time.Hour))
+
+		// Yesterday's trips only count once they pass today's start.
+		spans := []struct {
+			start time.Time
+			from  int
+		}{
+			{yesterday, int(today.Sub(yesterday) / time.Second)},
+			{today, 0},
 		}
 
-		points = append(points, [2]float64{shape.ShapePtLon, shape.ShapePtLat})
-
-	}
+		for _, span := range spans {
+			services, err := serv.activeServices(feedId, serviceDayOf(span.start))
+			if err != nil {
+				serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+				return []StopTime{}
+			}
+			if services.empty() {
+				continue
+			}
 
-	// Make sure we're not missing the last shape
-	if len(points) > 0 {
-		path := geo.NewPathFromXYData(points)
+			some := []StopTime{}
+			query := "select * from stoptime where (feedid, tripid) in " +
+				"(select feedid, tripid from trip where (feedid, serviceid) in " + activeServiceSQL + " and routeid = :routeId ) " +
+				"and stopid = :stopId and (:from = 0 or coalesce(departuretime, arrivaltime) >= :from) order by arrivaltime"
+
+			_, err = dbMap.Select(&some, query, services.bind(map[string]interface{}{
+				"routeId": routeId,
+				"stopId":  stopId,
+				"from":    span.from,
+			}))
+			if err != nil {
+				serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+				return []StopTime{}
+			}
 
-		reducedPath := reducers.DouglasPeucker(path, 1.0e-5)
-		encodedString := reducedPath.Encode()
-		all = append(all, ShapePath{
-			ShapeId: currentShape,
-			Path:    encodedString,
-		})
+			for i := range some {
+				some[i].placeOn(span.start)
+			}
+			all = append(all, some...)
+		}
 	}
 
+	sortStopTimes(all)
+	if err := overlayRealtime(all); err != nil {
+		log.Println("Overlaying realtime on stop", stopId, "failed.", err)
+	}
 	return all
 }
 
-func (serv TransitService) ShapeById(shapeId string) []ShapePath {
+func (serv TransitService) Shape(routeId string, directionId string, feed string, date string, format string, reducer string, tolerance string, encoding string) []ShapePath {
 	all := []ShapePath{}
 
-	query := "select * from shape where shapeid = :shapeId order by shapeid, shapeptsequence"
-
-	shapes := []Shape{}
+	options, err := serv.parseShapeOptions(format, reducer, tolerance, encoding)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
 
-	_, err := dbMap.Select(&shapes, query, map[string]interface{}{
-		"shapeId": shapeId,
-	})
+	day, err := parseServiceDate(date)
 	if err != nil {
-		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return all
 	}
 
-	var currentShape string
-	points := [][2]float64{}
+	services, err := serv.activeServices(feed, day)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
 
-	for _, shape := range shapes {
-		if currentShape != shape.ShapeId {
+	query := "select * from shape where (feedid, shapeid) in " +
+		"(select feedid, shapeid from trip where routeid = :route and directionid = :direction and (feedid, serviceid) in " + activeServiceSQL + ") " +
+		"order by feedid, shapeid, shapeptsequence"
 
-			if len(points) > 0 {
-				path := geo.NewPathFromXYData(points)
+	shapes := []Shape{}
 
-				reducedPath := reducers.DouglasPeucker(path, 1.0e-5)
-				encodedString := reducedPath.Encode()
-				all = append(all, ShapePath{
-					ShapeId: currentShape,
-					Path:    encodedString,
-				})
-			}
+	_, err = dbMap.Select(&shapes, query, services.bind(map[string]interface{}{
+		"route":     routeId,
+		"direction": directionId,
+	}))
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
 
-			points = [][2]float64{}
-			currentShape = shape.ShapeId
-		}
+	return serv.shapeResponse(shapes, options)
+}
 
-		points = append(points, [2]float64{shape.ShapePtLon, shape.ShapePtLat})
+func (serv TransitService) ShapeById(shapeId string, feed string, format string, reducer string, tolerance string, encoding string) []ShapePath {
+	all := []ShapePath{}
 
+	options, err := serv.parseShapeOptions(format, reducer, tolerance, encoding)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return all
 	}
 
-	// Make sure we're not missing the last shape
-	if len(points) > 0 {
-		path := geo.NewPathFromXYData(points)
+	query := "select * from shape where shapeid = :shapeId and (:feed = '' or feedid = :feed) order by feedid, shapeid, shapeptsequence"
 
-		reducedPath := reducers.DouglasPeucker(path, 1.0e-5)
-		encodedString := reducedPath.Encode()
-		all = append(all, ShapePath{
-			ShapeId: currentShape,
-			Path:    encodedString,
-		})
+	shapes := []Shape{}
+
+	_, err = dbMap.Select(&shapes, query, map[string]interface{}{
+		"shapeId": shapeId,
+		"feed":    feed,
+	})
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+		return all
 	}
 
-	return all
+	return serv.shapeResponse(shapes, options)
 }
 
-func (serv TransitService) NearestStopForRoute(routeId string, directionId string, lon string, lat string) Stop {
+func (serv TransitService) NearestStopForRoute(routeId string, directionId string, lon string, lat string, feed string, date string) Stop {
 
 	longitude, _ := strconv.ParseFloat(strings.TrimSpace(lon), 64)
 	latitude, _ := strconv.ParseFloat(strings.TrimSpace(lat), 64)
-	latLongPoint := geo.NewPoint(latitude, longitude)
-
-	stopsForRoute := serv.StopsForRoute(routeId, directionId)
-
-	var nearest Stop
-	distance := math.MaxFloat64
-	for _, stop := range stopsForRoute {
-		stopLatLong := geo.NewPoint(stop.StopLat, stop.StopLon)
-		currentDistance := stopLatLong.GeoDistanceFrom(latLongPoint, true)
-		if currentDistance < distance {
-			nearest = stop
-			distance = currentDistance
-		}
+	latLongPoint := geo.NewPoint(longitude, latitude)
+
+	day, err := parseServiceDate(date)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return Stop{}
+	}
+
+	stops, err := serv.routeStops(routeId, directionId, feed, day)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return Stop{}
 	}
 
-	return nearest
+	onRoute := map[[2]string]bool{}
+	for _, stop := range stops {
+		onRoute[[2]string{stop.FeedId, stop.StopId}] = true
+	}
+
+	nearest, err := nearestStops(feed, latLongPoint, 1, math.Inf(1), func(stop *Stop) bool {
+		return onRoute[[2]string{stop.FeedId, stop.StopId}]
+	})
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return Stop{}
+	}
+	if len(nearest) == 0 {
+		return Stop{}
+	}
+
+	return nearest[0].Stop
 }
 
-func (serv TransitService) StopsInRange(lon string, lat string, distance string) []Stop {
+func (serv TransitService) StopsInRange(lon string, lat string, distance string, feed string, format string) []Stop {
 
 	longitude, _ := strconv.ParseFloat(strings.TrimSpace(lon), 64)
 	latitude, _ := strconv.ParseFloat(strings.TrimSpace(lat), 64)
 
 	rangeToTarget, _ := strconv.ParseFloat(strings.TrimSpace(distance), 64)
 
-	latLongPoint := geo.NewPoint(latitude, longitude)
+	latLongPoint := geo.NewPoint(longitude, latitude)
 
-	all := []Stop{}
+	some := []Stop{}
 
-	_, err := dbMap.Select(&all, "select * from stop")
+	geoJSON, err := serv.wantsGeoJSON(format)
 	if err != nil {
-		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return some
 	}
 
-	some := []Stop{}
-
-	for _, stop := range all {
-		stopLatLong := geo.NewPoint(stop.StopLat, stop.StopLon)
+	if rangeToTarget > 0 {
+		found, err := stopsWithin(feed, latLongPoint, rangeToTarget)
+		if err != nil {
+			serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+			return some
+		}
 
-		if stopLatLong.GeoDistanceFrom(latLongPoint, true) < rangeToTarget {
-			some = append(some, stop)
+		for _, stop := range found {
+			some = append(some, stop.Stop)
 		}
 	}
 
+	if geoJSON {
+		serv.writeGeoJSON(stopFeatures(some))
+	}
+
 	return some
 }
 
-func (serv TransitService) StopsForRoute(routeId string, directionId string) []Stop {
-
-	services := serv.currentServiceList()
-
-	query := "select * from stop where stopid in " +
-		"(select distinct stopid from stoptime where tripid in " +
-		"(select distinct tripid from trip where routeid = :route and directionid = :direction and serviceid in (" + services + ")" +
-		"))"
+func (serv TransitService) StopsForRoute(routeId string, directionId string, feed string, date string, format string, order string) []Stop {
 
-	all := []Stop{}
+	geoJSON, err := serv.wantsGeoJSON(format)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return []Stop{}
+	}
+	if order != "" && order != "pattern" {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid order %q, expected pattern", order)))
+		return []Stop{}
+	}
 
-	_, err := dbMap.Select(&all, query, map[string]interface{}{
-		"route":     routeId,
-		"direction": directionId,
-	})
+	day, err := parseServiceDate(date)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return []Stop{}
+	}
 
+	all, err := serv.routeStops(routeId, directionId, feed, day)
 	if err != nil {
 		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+	if order == "pattern" {
+		if err := orderByPattern(all, routeId, directionId); err != nil {
+			serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+			return []Stop{}
+		}
+	}
+
+	if geoJSON {
+		serv.writeGeoJSON(stopFeatures(all))
 	}
 
 	return all
 }
 
-func (serv TransitService) FindStop(stopCode string) Stop {
+// routeStops returns the stops served by trips of a route in one
+// direction running on day.
+func (serv TransitService) routeStops(routeId string, directionId string, feed string, day serviceDay) ([]Stop, error) {
+	all := []Stop{}
+
+	services, err := serv.activeServices(feed, day)
+	if err != nil {
+		return all, err
+	}
+
+	query := "select * from stop where (feedid, stopid) in " +
+		"(select distinct feedid, stopid from stoptime where (feedid, tripid) in " +
+		"(select distinct feedid, tripid from trip where routeid = :route and directionid = :direction and (feedid, serviceid) in " + activeServiceSQL +
+		"))"
+
+	_, err = dbMap.Select(&all, query, services.bind(map[string]interface{}{
+		"route":     routeId,
+		"direction": directionId,
+	}))
+
+	return all, err
+}
+
+func (serv TransitService) FindStop(stopCode string, feed string) Stop {
 	var stop Stop
-	err := dbMap.SelectOne(&stop, "select * from stop where stopcode = :code", map[string]interface{}{
+	err := dbMap.SelectOne(&stop, "select * from stop where stopcode = :code and (:feed = '' or feedid = :feed) order by feedid limit 1", map[string]interface{}{
 		"code": stopCode,
+		"feed": feed,
 	})
 	if err != nil {
 		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
@@ -680,11 +1146,12 @@ func (serv TransitService) FindStop(stopCode string) Stop {
 	return stop
 }
 
-func (serv TransitService) Exceptions(date string) []CalendarDate {
+func (serv TransitService) Exceptions(date string, feed string) []CalendarDate {
 	exceptions := []CalendarDate{}
 
-	_, err := dbMap.Select(&exceptions, "select * from calendardate where date = :date", map[string]interface{}{
+	_, err := dbMap.Select(&exceptions, "select * from calendardate where date = :date and (:feed = '' or feedid = :feed)", map[string]interface{}{
 		"date": date,
+		"feed": feed,
 	})
 
 	if err != nil {
@@ -694,11 +1161,12 @@ func (serv TransitService) Exceptions(date string) []CalendarDate {
 	return exceptions
 }
 
-func (serv TransitService) FindRoute(shortName string) []Route {
+func (serv TransitService) FindRoute(shortName string, feed string) []Route {
 	all := []Route{}
 
-	_, err := dbMap.Select(&all, "select * from route where routeshortname like :name", map[string]interface{}{
+	_, err := dbMap.Select(&all, "select * from route where routeshortname like :name and (:feed = '' or feedid = :feed)", map[string]interface{}{
 		"name": shortName,
+		"feed": feed,
 	})
 
 	if err != nil {
@@ -708,10 +1176,12 @@ func (serv TransitService) FindRoute(shortName string) []Route {
 	return all
 }
 
-func (serv TransitService) AllCalendars() []Calendar {
+func (serv TransitService) AllCalendars(feed string) []Calendar {
 	all := []Calendar{}
 
-	_, err := dbMap.Select(&all, "select * from calendar")
+	_, err := dbMap.Select(&all, "select * from calendar where (:feed = '' or feedid = :feed)", map[string]interface{}{
+		"feed": feed,
+	})
 
 	if err != nil {
 		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
@@ -720,98 +1190,259 @@ func (serv TransitService) AllCalendars() []Calendar {
 	return all
 }
 
-func (serv TransitService) Calendars(year string, month string, day string) []Calendar {
+func (serv TransitService) Calendars(year string, month string, day string, feed string) []Calendar {
 	date, err := time.Parse("20060102", fmt.Sprintf("%v%v%v", year, month, day))
 	if err != nil {
 		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+		return []Calendar{}
 	}
 
-	return serv.currentService(date)
+	services, err := serv.currentService(feed, onDate(date))
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+	}
+	return services
 }
 
-func (serv TransitService) Calendar() []Calendar {
-	return serv.currentService(time.Now())
+func (serv TransitService) Calendar(feed string, date string) []Calendar {
+	day, err := parseServiceDate(date)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return []Calendar{}
+	}
+
+	services, err := serv.currentService(feed, day)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+	}
+	return services
 }
 
-func (serv TransitService) Service() []string {
+func (serv TransitService) Service(feed string, date string) []string {
 	serviceNames := []string{}
 
-	for _, calendar := range serv.currentService(time.Now()) {
+	day, err := parseServiceDate(date)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return serviceNames
+	}
+
+	services, err := serv.currentService(feed, day)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return serviceNames
+	}
+
+	for _, calendar := range services {
 		serviceNames = append(serviceNames, calendar.ServiceId)
 	}
 
 	return serviceNames
 }
 
-func (serv TransitService) currentService(time time.Time) []Calendar {
+// currentService returns the calendars running on the service day of
+// each feed the query covers, with the date taken in that feed's own
+// timezone.
+func (serv TransitService) currentService(feed string, day serviceDay) ([]Calendar, error) {
+	feedIds, err := feedIdsFor(feed)
+	if err != nil {
+		return nil, err
+	}
 
-	weekdays := []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+	all := []Calendar{}
+	for _, feedId := range feedIds {
+		services, err := servicesOn(feedId, day(feedLocation(feedId)))
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, services...)
+	}
 
-	// Figure out the current service
-	weekDay := int(time.Weekday())
+	return all, nil
+}
 
-	log.Println("Weekday = " + weekdays[weekDay])
+// parseServiceDate reads the optional date parameter of the schedule
+// endpoints, YYYYMMDD or YYYY-MM-DD. Empty means today.
+func parseServiceDate(date string) (serviceDay, error) {
+	if date == "" {
+		return today(), nil
+	}
+	for _, layout := range []string{"20060102", "2006-01-02"} {
+		if day, err := time.Parse(layout, date); err == nil {
+			return onDate(day), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid date %q, expected YYYYMMDD or YYYY-MM-DD", date)
+}
 
-	date := time.Format("20060102")
+// activeServices returns the services running on a day, to bind to a
+// query with activeServiceSQL.
+func (serv TransitService) activeServices(feed string, day serviceDay) (serviceSet, error) {
+	services, err := serv.currentService(feed, day)
+	if err != nil {
+		return serviceSet{}, err
+	}
+	return newServiceSet(services), nil
+}
 
-	log.Println("Date = " + date)
+func (serv TransitService) Routes(stopCode string, feed string, date string) []Route {
 
-	services := []Calendar{}
+	day, err := parseServiceDate(date)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return []Route{}
+	}
 
-	query := "select * from calendar where serviceid in " +
-		"(select serviceid from calendar " +
-		"where startdate <= :date " +
-		"and enddate >= :date and " + weekdays[weekDay] + " = '1' " +
-		"and serviceid not in " +
-		"(select serviceid from calendardate where date = :date and exceptiontype = '2') " +
-		") " +
-		"or serviceid in " +
-		"(select serviceid from calendardate where date = :date and exceptiontype = '1') "
+	services, err := serv.activeServices(feed, day)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return []Route{}
+	}
 
-	log.Println(query)
+	routes := []Route{}
 
-	_, err := dbMap.Select(&services, query,
-		map[string]interface{}{
-			"date": date,
-		})
-	checkErr(err, "Query failed")
+	_, err = dbMap.Select(&routes,
+		"select * from route where (feedid, routeid) in "+
+			" (select distinct feedid, routeid from trip where (feedid, tripid) in "+
+			" (select distinct feedid, tripid from stoptime where stopid = :stopid) and (feedid, serviceid) in "+activeServiceSQL+")"+
+			" order by routeshortname",
+		services.bind(map[string]interface{}{
+			"stopid": stopCode,
+		}))
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+	}
 
-	return services
+	return routes
 }
 
-func (serv TransitService) serviceStringList(services []Calendar) string {
+func (serv TransitService) Frequencies(tripId string, feed string) []Frequency {
+	all := []Frequency{}
+
+	_, err := dbMap.Select(&all, "select * from frequency where tripid = :tripId and (:feed = '' or feedid = :feed) order by starttime", map[string]interface{}{
+		"tripId": tripId,
+		"feed":   feed,
+	})
 
-	serviceIds := []string{}
-	for _, val := range services {
-		serviceIds = append(serviceIds, fmt.Sprintf("'%v'", val.ServiceId))
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
 	}
 
-	serviceString := strings.Join(serviceIds, ",")
-	return serviceString
+	return all
 }
 
-func (serv TransitService) currentServiceList() string {
-	services := serv.currentService(time.Now())
-	return serv.serviceStringList(services)
+func (serv TransitService) Transfers(stopId string, feed string) []Transfer {
+	all := []Transfer{}
+
+	_, err := dbMap.Select(&all, "select * from transfer where (fromstopid = :stopId or tostopid = :stopId) and (:feed = '' or feedid = :feed)", map[string]interface{}{
+		"stopId": stopId,
+		"feed":   feed,
+	})
+
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+	}
+
+	return all
 }
 
-func (serv TransitService) Routes(stopCode string) []Route {
+func (serv TransitService) FeedInfo(feed string) []FeedInfo {
+	all := []FeedInfo{}
 
-	services := serv.currentServiceList()
+	_, err := dbMap.Select(&all, "select * from feedinfo where (:feed = '' or feedid = :feed)", map[string]interface{}{
+		"feed": feed,
+	})
 
-	routes := []Route{}
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+	}
+
+	return all
+}
+
+func (serv TransitService) Fares(feed string) []FareAttribute {
+	all := []FareAttribute{}
+
+	_, err := dbMap.Select(&all, "select * from fareattribute where (:feed = '' or feedid = :feed) order by fareid", map[string]interface{}{
+		"feed": feed,
+	})
 
-	_, err := dbMap.Select(&routes,
-		"select * from route where routeid in "+
-			" (select distinct routeid from trip where tripid in "+
-			" (select distinct tripid from stoptime where stopid = :stopid) and serviceid in ("+services+"))"+
-			" order by routeshortname",
-		map[string]interface{}{
-			"stopid": stopCode,
-		})
 	if err != nil {
 		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
 	}
 
-	return routes
+	return all
+}
+
+func (serv TransitService) FareRules(fareId string, feed string) []FareRule {
+	all := []FareRule{}
+
+	_, err := dbMap.Select(&all, "select * from farerule where fareid = :fareId and (:feed = '' or feedid = :feed)", map[string]interface{}{
+		"fareId": fareId,
+		"feed":   feed,
+	})
+
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+	}
+
+	return all
+}
+
+func (serv TransitService) Levels(feed string) []Level {
+	all := []Level{}
+
+	_, err := dbMap.Select(&all, "select * from level where (:feed = '' or feedid = :feed) order by levelindex", map[string]interface{}{
+		"feed": feed,
+	})
+
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+	}
+
+	return all
+}
+
+func (serv TransitService) Pathways(stopId string, feed string) []Pathway {
+	all := []Pathway{}
+
+	_, err := dbMap.Select(&all, "select * from pathway where (fromstopid = :stopId or tostopid = :stopId) and (:feed = '' or feedid = :feed)", map[string]interface{}{
+		"stopId": stopId,
+		"feed":   feed,
+	})
+
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+	}
+
+	return all
+}
+
+func (serv TransitService) Attributions(feed string) []Attribution {
+	all := []Attribution{}
+
+	_, err := dbMap.Select(&all, "select * from attribution where (:feed = '' or feedid = :feed)", map[string]interface{}{
+		"feed": feed,
+	})
+
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+	}
+
+	return all
+}
+
+func (serv TransitService) Translations(language string, feed string) []Translation {
+	all := []Translation{}
+
+	_, err := dbMap.Select(&all, "select * from translation where language = :language and (:feed = '' or feedid = :feed)", map[string]interface{}{
+		"language": language,
+		"feed":     feed,
+	})
+
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(404).WriteAndOveride([]byte(err.Error()))
+	}
+
+	return all
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+)
+
+// The Mapbox Vector Tile format is a protocol buffer message; it is
+// simple enough to write by hand. See
+// https://github.com/mapbox/vector-tile-spec/tree/master/2.1
+const (
+	mvtVersion = 2
+
+	mvtPoint      = 1
+	mvtLineString = 2
+
+	mvtMoveTo = 1
+	mvtLineTo = 2
+)
+
+// mvtProperty is one attribute of a tile feature, a string or an int.
+type mvtProperty struct {
+	key   string
+	value interface{}
+}
+
+// mvtLayer collects the features of one layer of a tile, sharing keys
+// and values between them.
+type mvtLayer struct {
+	name     string
+	extent   int
+	features [][]byte
+	keys     []string
+	values   []interface{}
+	keyIds   map[string]uint32
+	valueIds map[interface{}]uint32
+}
+
+func newMvtLayer(name string, extent int) *mvtLayer {
+	return &mvtLayer{
+		name:     name,
+		extent:   extent,
+		keyIds:   map[string]uint32{},
+		valueIds: map[interface{}]uint32{},
+	}
+}
+
+// add appends a feature with the given geometry commands. Empty string
+// properties are left out.
+func (layer *mvtLayer) add(geomType int, geometry []uint32, properties []mvtProperty) {
+	tags := []uint32{}
+	for _, property := range properties {
+		if property.value == "" {
+			continue
+		}
+
+		key, ok := layer.keyIds[property.key]
+		if !ok {
+			key = uint32(len(layer.keys))
+			layer.keyIds[property.key] = key
+			layer.keys = append(layer.keys, property.key)
+		}
+		value, ok := layer.valueIds[property.value]
+		if !ok {
+			value = uint32(len(layer.values))
+			layer.valueIds[property.value] = value
+			layer.values = append(layer.values, property.value)
+		}
+		tags = append(tags, key, value)
+	}
+
+	feature := protoPacked(nil, 2, tags)
+	feature = protoVarintField(feature, 3, uint64(geomType))
+	feature = protoPacked(feature, 4, geometry)
+	layer.features = append(layer.features, feature)
+}
+
+// encode returns the layer as a Layer message.
+func (layer *mvtLayer) encode() []byte {
+	out := protoVarintField(nil, 15, mvtVersion)
+	out = protoBytesField(out, 1, []byte(layer.name))
+	for _, feature := range layer.features {
+		out = protoBytesField(out, 2, feature)
+	}
+	for _, key := range layer.keys {
+		out = protoBytesField(out, 3, []byte(key))
+	}
+	for _, value := range layer.values {
+		var encoded []byte
+		switch v := value.(type) {
+		case string:
+			encoded = protoBytesField(nil, 1, []byte(v))
+		case int:
+			encoded = protoVarintField(nil, 6, zigzag(v))
+		}
+		out = protoBytesField(out, 4, encoded)
+	}
+	return protoVarintField(out, 5, uint64(layer.extent))
+}
+
+// encodeTile returns a Tile message holding the layers with features.
+func encodeTile(layers ...*mvtLayer) []byte {
+	tile := []byte{}
+	for _, layer := range layers {
+		if len(layer.features) > 0 {
+			tile = protoBytesField(tile, 3, layer.encode())
+		}
+	}
+	return tile
+}
+
+// mvtGeometry builds the command stream of a feature's geometry, with
+// coordinates relative to the previous point.
+type mvtGeometry struct {
+	commands []uint32
+	x, y     int
+}
+
+func (g *mvtGeometry) moveTo(x, y int) {
+	g.commands = append(g.commands, command(mvtMoveTo, 1))
+	g.step(x, y)
+}
+
+func (g *mvtGeometry) lineTo(points [][2]int) {
+	g.commands = append(g.commands, command(mvtLineTo, len(points)))
+	for _, p := range points {
+		g.step(p[0], p[1])
+	}
+}
+
+func (g *mvtGeometry) step(x, y int) {
+	g.commands = append(g.commands, uint32(zigzag(x-g.x)), uint32(zigzag(y-g.y)))
+	g.x, g.y = x, y
+}
+
+// line adds a line through points, dropping repeated points. Lines of
+// fewer than two distinct points are skipped.
+func (g *mvtGeometry) line(points [][2]float64) {
+	distinct := [][2]int{}
+	for _, p := range points {
+		q := [2]int{int(math.Floor(p[0] + 0.5)), int(math.Floor(p[1] + 0.5))}
+		if len(distinct) == 0 || distinct[len(distinct)-1] != q {
+			distinct = append(distinct, q)
+		}
+	}
+	if len(distinct) < 2 {
+		return
+	}
+
+	g.moveTo(distinct[0][0], distinct[0][1])
+	g.lineTo(distinct[1:])
+}
+
+func command(id int, count int) uint32 {
+	return uint32(id&0x7 | count<<3)
+}
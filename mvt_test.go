@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// decodeFields reads the values of a message's fields in order, varints
+// as uint64 and length-delimited values as []byte.
+func decodeFields(t *testing.T, data []byte) map[int][]interface{} {
+	fields := map[int][]interface{}{}
+	r := &protoReader{data: data}
+	for r.next() {
+		switch r.wire {
+		case wireVarint:
+			fields[r.field] = append(fields[r.field], r.varint())
+		case wireBytes:
+			fields[r.field] = append(fields[r.field], r.bytes())
+		default:
+			t.Fatalf("unexpected wire type %d for field %d", r.wire, r.field)
+		}
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return fields
+}
+
+// decodePacked reads packed varints.
+func decodePacked(t *testing.T, data []byte) []uint64 {
+	values := []uint64{}
+	r := &protoReader{data: data}
+	for len(r.data) > 0 && r.err == nil {
+		values = append(values, r.varint())
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return values
+}
+
+func TestEncodeTile(t *testing.T) {
+	routes := newMvtLayer("routes", tileExtent)
+	geometry := &mvtGeometry{}
+	geometry.line([][2]float64{{2, 2}, {2, 2}, {10, 2}, {10, 10}})
+	routes.add(mvtLineString, geometry.commands, []mvtProperty{
+		{"route_id", "10"},
+		{"route_color", ""},
+		{"route_type", 3},
+		{"route_short_name", "10"},
+	})
+
+	tile := decodeFields(t, encodeTile(newMvtLayer("stops", tileExtent), routes))
+	if len(tile[3]) != 1 {
+		t.Fatalf("tile has %d layers, want only the one with features", len(tile[3]))
+	}
+
+	layer := decodeFields(t, tile[3][0].([]byte))
+	if name := string(layer[1][0].([]byte)); name != "routes" {
+		t.Errorf("layer name = %q", name)
+	}
+	if version, extent := layer[15][0].(uint64), layer[5][0].(uint64); version != mvtVersion || extent != tileExtent {
+		t.Errorf("version %d, extent %d", version, extent)
+	}
+	keys := []string{}
+	for _, key := range layer[3] {
+		keys = append(keys, string(key.([]byte)))
+	}
+	if want := []string{"route_id", "route_type", "route_short_name"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("keys = %v, want %v", keys, want)
+	}
+	values := []map[int][]interface{}{}
+	for _, value := range layer[4] {
+		values = append(values, decodeFields(t, value.([]byte)))
+	}
+	if len(values) != 2 || string(values[0][1][0].([]byte)) != "10" || values[1][6][0].(uint64) != zigzag(3) {
+		t.Errorf("values = %v", values)
+	}
+
+	feature := decodeFields(t, layer[2][0].([]byte))
+	if geomType := feature[3][0].(uint64); geomType != mvtLineString {
+		t.Errorf("geometry type = %d", geomType)
+	}
+	// Tags pair key and value indexes; the repeated "10" shares a value.
+	if tags, want := decodePacked(t, feature[2][0].([]byte)), []uint64{0, 0, 1, 1, 2, 0}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags = %v, want %v", tags, want)
+	}
+	// MoveTo(2, 2), then LineTo by (+8, 0) and (0, +8), the repeated point
+	// dropped.
+	want := []uint64{uint64(command(mvtMoveTo, 1)), zigzag(2), zigzag(2), uint64(command(mvtLineTo, 2)), zigzag(8), 0, 0, zigzag(8)}
+	if commands := decodePacked(t, feature[4][0].([]byte)); !reflect.DeepEqual(commands, want) {
+		t.Errorf("commands = %v, want %v", commands, want)
+	}
+}
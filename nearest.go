@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/go.geo"
+)
+
+const (
+	defaultNearestCount    = 10
+	maxNearestCount        = 100
+	defaultNearestDistance = 1000.0
+	// maxNearestCandidates is how many of the nearest stops are looked
+	// through for those served by a routeType.
+	maxNearestCandidates = 1600
+)
+
+// NearbyStop is a stop near a point: how far away it is in metres, the
+// compass bearing to it and the routes serving it today.
+type NearbyStop struct {
+	Stop
+	Distance float64 `json:"distance"`
+	Bearing  float64 `json:"bearing"`
+	Routes   []Route `json:"routes"`
+}
+
+// stopRoute links a stop to a route serving it.
+type stopRoute struct {
+	FeedId  string
+	StopId  string
+	RouteId string
+}
+
+// NearestStops lists the k stops closest to a point, nearest first, no
+// further than maxDistance metres, optionally only those served today by
+// routes of routeType.
+func (serv TransitService) NearestStops(lat string, lon string, k string, maxDistance string, routeType string, feed string) []NearbyStop {
+	latitude, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid lat %q", lat)))
+		return []NearbyStop{}
+	}
+	longitude, err := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid lon %q", lon)))
+		return []NearbyStop{}
+	}
+	count, err := parseLimit(k, defaultNearestCount)
+	if err != nil || count > maxNearestCount {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid k %q, expected 1 to %d", k, maxNearestCount)))
+		return []NearbyStop{}
+	}
+	distance := defaultNearestDistance
+	if maxDistance != "" {
+		distance, err = strconv.ParseFloat(strings.TrimSpace(maxDistance), 64)
+		if err != nil || distance <= 0 {
+			serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid maxDistance %q", maxDistance)))
+			return []NearbyStop{}
+		}
+	}
+
+	services, err := serv.activeServices(feed, today())
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return []NearbyStop{}
+	}
+
+	// With a routeType, ever more of the nearest stops are looked at
+	// until k of them are served by a route of that type, or there are no
+	// more within maxDistance.
+	point := geo.NewPoint(longitude, latitude)
+	found := []nearStop{}
+	var routes map[[2]string][]Route
+	for batch := count; ; batch *= 4 {
+		candidates, err := nearestStops(feed, point, batch, distance, nil)
+		if err != nil {
+			serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+			return []NearbyStop{}
+		}
+
+		routes, err = routesServing(candidates, services)
+		if err != nil {
+			serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+			return []NearbyStop{}
+		}
+
+		found = candidates[:0]
+		for _, stop := range candidates {
+			if routeType == "" || servedBy(routes[[2]string{stop.FeedId, stop.StopId}], routeType) {
+				found = append(found, stop)
+			}
+		}
+		if len(found) >= count || len(candidates) < batch || batch >= maxNearestCandidates {
+			break
+		}
+	}
+	if len(found) > count {
+		found = found[:count]
+	}
+
+	nearby := []NearbyStop{}
+	for _, stop := range found {
+		stopRoutes := []Route{}
+		for _, route := range routes[[2]string{stop.FeedId, stop.StopId}] {
+			if routeType == "" || route.RouteType == routeType {
+				stopRoutes = append(stopRoutes, route)
+			}
+		}
+
+		nearby = append(nearby, NearbyStop{
+			Stop:     stop.Stop,
+			Distance: math.Round(stop.distance*10) / 10,
+			Bearing:  compassBearing(point, stopPoint(&stop.Stop)),
+			Routes:   stopRoutes,
+		})
+	}
+
+	return nearby
+}
+
+// compassBearing returns the initial bearing from one point to another
+// in degrees clockwise from north, 0 to 360.
+func compassBearing(from *geo.Point, to *geo.Point) float64 {
+	bearing := math.Mod(from.BearingTo(to)+360, 360)
+	return math.Round(bearing*10) / 10
+}
+
+// servedBy tells whether any of routes is of routeType.
+func servedBy(routes []Route, routeType string) bool {
+	for _, route := range routes {
+		if route.RouteType == routeType {
+			return true
+		}
+	}
+	return false
+}
+
+// routesServing returns the routes running on the given services that
+// serve each stop, keyed by feed and stop ID, in short name order.
+func routesServing(stops []nearStop, services serviceSet) (map[[2]string][]Route, error) {
+	served := map[[2]string][]Route{}
+	if len(stops) == 0 || services.empty() {
+		return served, nil
+	}
+
+	stopFeeds, stopIds := textArray{}, textArray{}
+	for _, stop := range stops {
+		stopFeeds = append(stopFeeds, stop.FeedId)
+		stopIds = append(stopIds, stop.StopId)
+	}
+
+	links := []stopRoute{}
+	_, err := dbMap.Select(&links, "select distinct st.feedid, st.stopid, t.routeid from stoptime st "+
+		"join trip t on t.feedid = st.feedid and t.tripid = st.tripid "+
+		"where (st.feedid, st.stopid) in (select * from unnest(cast(:stopFeeds as text[]), cast(:stopIds as text[]))) "+
+		"and (t.feedid, t.serviceid) in "+activeServiceSQL,
+		services.bind(map[string]interface{}{
+			"stopFeeds": stopFeeds,
+			"stopIds":   stopIds,
+		}))
+	if err != nil {
+		return nil, err
+	}
+	if len(links) == 0 {
+		return served, nil
+	}
+
+	routeFeeds, routeIds := textArray{}, textArray{}
+	for _, link := range links {
+		routeFeeds = append(routeFeeds, link.FeedId)
+		routeIds = append(routeIds, link.RouteId)
+	}
+
+	routes := []Route{}
+	_, err = dbMap.Select(&routes, "select * from route "+
+		"where (feedid, routeid) in (select * from unnest(cast(:routeFeeds as text[]), cast(:routeIds as text[]))) "+
+		"order by routeshortname", map[string]interface{}{
+		"routeFeeds": routeFeeds,
+		"routeIds":   routeIds,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stopsOf := map[[2]string][]string{}
+	for _, link := range links {
+		key := [2]string{link.FeedId, link.RouteId}
+		stopsOf[key] = append(stopsOf[key], link.StopId)
+	}
+	for _, route := range routes {
+		for _, stopId := range stopsOf[[2]string{route.FeedId, route.RouteId}] {
+			key := [2]string{route.FeedId, stopId}
+			served[key] = append(served[key], route)
+		}
+	}
+
+	return served, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// Pattern is a sequence of stops the trips of a route call at, in one
+// direction along one shape. Patterns are derived from the trips when a
+// feed is loaded; the one of a route direction with the most trips is
+// numbered 1.
+type Pattern struct {
+	FeedId       string `json:"feed_id"`
+	PatternId    string `json:"pattern_id"`
+	RouteId      string `json:"route_id"`
+	DirectionId  int    `json:"direction_id,string"`
+	ShapeId      string `json:"shape_id"`
+	TripHeadsign string `json:"trip_headsign"`
+	TripCount    int    `json:"trip_count"`
+	Stops        []Stop `json:"stops" db:"-"`
+}
+
+// PatternStop is a stop of a pattern, StopIndex counting from 0.
+type PatternStop struct {
+	FeedId    string `json:"feed_id"`
+	PatternId string `json:"pattern_id"`
+	StopIndex int    `json:"stop_index"`
+	StopId    string `json:"stop_id"`
+}
+
+// derivePatterns groups the staged trips by route, direction, shape and
+// the stops they call at, in order, into patterns.
+func (staging *stagingArea) derivePatterns() error {
+	log.Println("Deriving patterns in", staging.schema)
+
+	statements := []string{
+		"create table " + staging.table("tripstops") + " as " +
+			"select t.feedid, t.routeid, t.directionid, t.shapeid, t.tripid, t.tripheadsign, " +
+			"array_agg(st.stopid order by st.stopsequence) as stops " +
+			"from " + staging.table("trip") + " t join " + staging.table("stoptime") + " st on st.feedid = t.feedid and st.tripid = t.tripid " +
+			"group by t.feedid, t.routeid, t.directionid, t.shapeid, t.tripid, t.tripheadsign",
+		"create table " + staging.table("patterns") + " as " +
+			"select feedid, routeid, directionid, shapeid, stops, count(*) as tripcount, " +
+			"mode() within group (order by tripheadsign) as tripheadsign, " +
+			"routeid || ':' || directionid || ':' || row_number() over (partition by feedid, routeid, directionid order by count(*) desc, min(tripid)) as patternid " +
+			"from " + staging.table("tripstops") + " group by feedid, routeid, directionid, shapeid, stops",
+		"insert into " + staging.table("pattern") + " (feedid, patternid, routeid, directionid, shapeid, tripheadsign, tripcount) " +
+			"select feedid, patternid, routeid, directionid, shapeid, tripheadsign, tripcount from " + staging.table("patterns"),
+		"insert into " + staging.table("patternstop") + " (feedid, patternid, stopindex, stopid) " +
+			"select p.feedid, p.patternid, s.n - 1, s.stopid from " + staging.table("patterns") + " p, " +
+			"unnest(p.stops) with ordinality as s(stopid, n)",
+	}
+	for _, statement := range statements {
+		if _, err := dbMap.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Patterns returns the patterns of a route, optionally only those of
+// one direction, each with its stops in order.
+func (serv TransitService) Patterns(routeId string, directionId string, feed string) []Pattern {
+	all := []Pattern{}
+
+	query := "select * from pattern where routeid = :route and (:feed = '' or feedid = :feed)"
+	if directionId != "" {
+		if _, err := strconv.Atoi(directionId); err != nil {
+			serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid directionId %q", directionId)))
+			return all
+		}
+		query += " and directionid = :direction"
+	}
+	params := map[string]interface{}{
+		"route":     routeId,
+		"direction": directionId,
+		"feed":      feed,
+	}
+
+	_, err := dbMap.Select(&all, query+" order by feedid, directionid, tripcount desc, patternid", params)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+
+	patternStops := []PatternStop{}
+	_, err = dbMap.Select(&patternStops, "select * from patternstop where (feedid, patternid) in (select feedid, patternid from ("+query+") patterns) "+
+		"order by feedid, patternid, stopindex", params)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return []Pattern{}
+	}
+
+	stops := []Stop{}
+	_, err = dbMap.Select(&stops, "select * from stop where (feedid, stopid) in (select feedid, stopid from patternstop "+
+		"where (feedid, patternid) in (select feedid, patternid from ("+query+") patterns))", params)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return []Pattern{}
+	}
+
+	stopsById := map[[2]string]Stop{}
+	for _, stop := range stops {
+		stopsById[[2]string{stop.FeedId, stop.StopId}] = stop
+	}
+	stopsOf := map[[2]string][]Stop{}
+	for _, ps := range patternStops {
+		key := [2]string{ps.FeedId, ps.PatternId}
+		stopsOf[key] = append(stopsOf[key], stopsById[[2]string{ps.FeedId, ps.StopId}])
+	}
+	for i := range all {
+		all[i].Stops = stopsOf[[2]string{all[i].FeedId, all[i].PatternId}]
+		if all[i].Stops == nil {
+			all[i].Stops = []Stop{}
+		}
+	}
+
+	return all
+}
+
+// orderByPattern sorts the stops of a route direction as its patterns
+// call at them: the stops of the pattern with the most trips in order,
+// then those only other patterns call at, as they first come across
+// them.
+func orderByPattern(stops []Stop, routeId string, directionId string) error {
+	patternStops := []PatternStop{}
+	_, err := dbMap.Select(&patternStops, "select ps.* from patternstop ps "+
+		"join pattern p on p.feedid = ps.feedid and p.patternid = ps.patternid "+
+		"where p.routeid = :route and p.directionid = :direction "+
+		"order by p.feedid, p.tripcount desc, p.patternid, ps.stopindex", map[string]interface{}{
+		"route":     routeId,
+		"direction": directionId,
+	})
+	if err != nil {
+		return err
+	}
+
+	position := map[[2]string]int{}
+	for _, ps := range patternStops {
+		key := [2]string{ps.FeedId, ps.StopId}
+		if _, ok := position[key]; !ok {
+			position[key] = len(position)
+		}
+	}
+
+	rank := func(stop Stop) int {
+		if p, ok := position[[2]string{stop.FeedId, stop.StopId}]; ok {
+			return p
+		}
+		return len(position)
+	}
+	sort.SliceStable(stops, func(i, j int) bool {
+		return rank(stops[i]) < rank(stops[j])
+	})
+	return nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/go.geo"
+)
+
+const (
+	defaultPlanWalk      = 800.0
+	maxPlanWalk          = 5000.0
+	defaultPlanTransfers = 3
+	maxPlanTransfers     = 8
+)
+
+// Itinerary is one way to make a journey: no other is both faster and
+// has fewer transfers.
+type Itinerary struct {
+	FeedId       string    `json:"feed_id"`
+	Departs      time.Time `json:"departs"`
+	Arrives      time.Time `json:"arrives"`
+	Duration     int       `json:"duration"`
+	Transfers    int       `json:"transfers"`
+	WalkDistance float64   `json:"walk_distance"`
+	Legs         []Leg     `json:"legs"`
+}
+
+// Leg is a part of an itinerary spent walking, or riding one trip.
+type Leg struct {
+	Mode           string    `json:"mode"`
+	From           Place     `json:"from"`
+	To             Place     `json:"to"`
+	Departs        time.Time `json:"departs"`
+	Arrives        time.Time `json:"arrives"`
+	Distance       float64   `json:"distance,omitempty"`
+	TripId         string    `json:"trip_id,omitempty"`
+	RouteId        string    `json:"route_id,omitempty"`
+	RouteShortName string    `json:"route_short_name,omitempty"`
+	TripHeadsign   string    `json:"trip_headsign,omitempty"`
+	ServiceDate    *GtfsDate `json:"service_date,omitempty"`
+}
+
+// Place is where a leg starts or ends: a stop, or the coordinates a
+// journey was planned from or to.
+type Place struct {
+	StopId   string  `json:"stop_id,omitempty"`
+	StopName string  `json:"stop_name,omitempty"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+}
+
+// planPlace is the origin or destination of a journey, given as
+// "lat,lon" or as a stop ID.
+type planPlace struct {
+	point  *geo.Point
+	stopId string
+}
+
+func parsePlace(name string, value string) (planPlace, error) {
+	if value == "" {
+		return planPlace{}, fmt.Errorf("missing %s, expected lat,lon or a stop ID", name)
+	}
+	if parts := strings.Split(value, ","); len(parts) == 2 {
+		lat, latErr := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lon, lonErr := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if latErr == nil && lonErr == nil {
+			if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+				return planPlace{}, fmt.Errorf("invalid %s %q", name, value)
+			}
+			return planPlace{point: geo.NewPoint(lon, lat)}, nil
+		}
+	}
+	return planPlace{stopId: value}, nil
+}
+
+// Plan finds journeys from one place to another leaving at or after
+// time, or with arriveBy arriving at or before it, as RFC 3339 or a
+// time of day today as for Departures. Places are "lat,lon" or stop IDs.
+// Journeys walk up to maxWalk metres to and from stops, change at most
+// maxTransfers times, and stay within one feed.
+func (serv TransitService) Plan(from string, to string, at string, arriveBy string, maxWalk string, maxTransfers string, feed string) []Itinerary {
+	all := []Itinerary{}
+
+	origin, err := parsePlace("from", from)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+	destination, err := parsePlace("to", to)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+	if _, err := parseFrom(at, time.Now()); err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid time %q, expected RFC 3339 or HH:MM[:SS]", at)))
+		return all
+	}
+	backwards := false
+	if arriveBy != "" {
+		if backwards, err = strconv.ParseBool(arriveBy); err != nil {
+			serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid arriveBy %q", arriveBy)))
+			return all
+		}
+	}
+	walk := defaultPlanWalk
+	if maxWalk != "" {
+		if walk, err = strconv.ParseFloat(maxWalk, 64); err != nil || walk < 0 || walk > maxPlanWalk {
+			serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid maxWalk %q, expected 0 to %v metres", maxWalk, maxPlanWalk)))
+			return all
+		}
+	}
+	transfers := defaultPlanTransfers
+	if maxTransfers != "" {
+		if transfers, err = strconv.Atoi(maxTransfers); err != nil || transfers < 0 || transfers > maxPlanTransfers {
+			serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid maxTransfers %q, expected 0 to %d", maxTransfers, maxPlanTransfers)))
+			return all
+		}
+	}
+
+	feedIds, err := feedIdsFor(feed)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+	for _, feedId := range feedIds {
+		some, err := planJourneys(feedId, origin, destination, at, backwards, walk, transfers+1)
+		if err != nil {
+			serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+			return []Itinerary{}
+		}
+		all = append(all, some...)
+	}
+
+	return paretoItineraries(all, backwards)
+}
+
+// planJourneys searches one feed for journeys between two places. A
+// place given as a stop ID the feed does not have finds nothing.
+func planJourneys(feedId string, origin planPlace, destination planPlace, at string, arriveBy bool, maxWalk float64, maxRides int) ([]Itinerary, error) {
+	loc := feedLocation(feedId)
+	instant, err := parseFrom(at, time.Now().In(loc))
+	if err != nil {
+		return nil, err
+	}
+	start := serviceDayStart(instant.In(loc))
+
+	tt, err := timetableFor(feedId, start)
+	if err != nil {
+		return nil, err
+	}
+	return tt.journeys(origin, destination, instant, arriveBy, maxWalk, maxRides), nil
+}
+
+// journeys searches the timetable for journeys between two places
+// leaving at or after instant, or arriving by it.
+func (tt *timetable) journeys(origin planPlace, destination planPlace, instant time.Time, arriveBy bool, maxWalk float64, maxRides int) []Itinerary {
+	access, fromPlace, ok := tt.walksAround(origin, maxWalk)
+	if !ok {
+		return nil
+	}
+	egress, toPlace, ok := tt.walksAround(destination, maxWalk)
+	if !ok {
+		return nil
+	}
+
+	itineraries := []Itinerary{}
+	if origin.point != nil && destination.point != nil {
+		if distance := origin.point.GeoDistanceFrom(destination.point, true); distance <= maxWalk {
+			duration := time.Duration(walkSeconds(distance)) * time.Second
+			walk := Leg{Mode: "walk", From: fromPlace, To: toPlace, Departs: instant, Arrives: instant.Add(duration), Distance: distance}
+			if arriveBy {
+				walk.Departs, walk.Arrives = instant.Add(-duration), instant
+			}
+			itineraries = append(itineraries, newItinerary(tt.feedId, []Leg{walk}))
+		}
+	}
+
+	search, depart := tt, int(instant.Sub(tt.start)/time.Second)
+	if arriveBy {
+		search, depart = tt.reversed(), -depart
+		access, egress = egress, access
+	}
+
+	labels, ends := search.raptor(depart, unreached, access, egress, maxRides)
+	for _, end := range ends {
+		legs := search.legs(labels, end)
+		for _, walk := range egress {
+			if walk.stop == end.stop {
+				legs = append(legs, rawLeg{from: end.stop, to: -1, departs: end.time - walk.seconds, arrives: end.time, distance: walk.distance})
+				break
+			}
+		}
+		if arriveBy {
+			legs = reverseLegs(legs)
+		}
+		itineraries = append(itineraries, newItinerary(tt.feedId, tt.placeLegs(legs, fromPlace, toPlace)))
+	}
+
+	return itineraries
+}
+
+// walksAround returns the stops a journey can walk between and a place,
+// with the place itself: the stops within maxWalk of coordinates, or a
+// stop and those it is a transfer away from. It tells whether the
+// place is in the timetable's feed.
+func (tt *timetable) walksAround(place planPlace, maxWalk float64) ([]stopWalk, Place, bool) {
+	center, radius := place.point, maxWalk
+	var at Place
+	if place.point == nil {
+		stop, ok := tt.stopIds[place.stopId]
+		if !ok {
+			return nil, Place{}, false
+		}
+		center, radius = stopPoint(&tt.stops[stop]), transferDistance
+		at = tt.place(stop)
+	} else {
+		at = Place{Lat: center.Lat(), Lon: center.Lng()}
+	}
+
+	walks := []stopWalk{}
+	for _, near := range tt.index.within(center, radius, nil) {
+		if stop, ok := tt.stopIds[near.StopId]; ok {
+			walks = append(walks, stopWalk{stop, walkSeconds(near.distance), near.distance})
+		}
+	}
+	return walks, at, true
+}
+
+// place returns a stop of the timetable as a Place.
+func (tt *timetable) place(stop int) Place {
+	s := tt.stops[stop]
+	return Place{StopId: s.StopId, StopName: s.StopName, Lat: s.StopLat, Lon: s.StopLon}
+}
+
+// reverseLegs turns the legs of a search of a reversed timetable the
+// right way round.
+func reverseLegs(legs []rawLeg) []rawLeg {
+	forward := make([]rawLeg, len(legs))
+	for i, leg := range legs {
+		leg.from, leg.to = leg.to, leg.from
+		leg.departs, leg.arrives = -leg.arrives, -leg.departs
+		forward[len(legs)-1-i] = leg
+	}
+	return forward
+}
+
+// placeLegs turns the legs of a search into those of an itinerary.
+// Walks before the first ride are timed to end as it leaves, later ones
+// to start as the leg before arrives. Walks that go nowhere are left
+// out.
+func (tt *timetable) placeLegs(raw []rawLeg, from Place, to Place) []Leg {
+	first := 0
+	for first < len(raw) && !raw[first].ride {
+		first++
+	}
+
+	for i := range raw {
+		if raw[i].ride {
+			continue
+		}
+		duration := raw[i].arrives - raw[i].departs
+		if raw[i].from < 0 || raw[i].to < 0 {
+			duration = walkSeconds(raw[i].distance)
+		}
+		if i > first {
+			raw[i].departs = raw[i-1].arrives
+			raw[i].arrives = raw[i].departs + duration
+		}
+	}
+	for i := first - 1; i >= 0; i-- {
+		duration := walkSeconds(raw[i].distance)
+		if raw[i].from >= 0 && raw[i].to >= 0 {
+			duration = raw[i].arrives - raw[i].departs
+		}
+		raw[i].arrives = raw[i+1].departs
+		raw[i].departs = raw[i].arrives - duration
+	}
+
+	at := func(seconds int) time.Time {
+		return tt.start.Add(time.Duration(seconds) * time.Second)
+	}
+	placeOf := func(stop int, otherwise Place) Place {
+		if stop < 0 {
+			return otherwise
+		}
+		return tt.place(stop)
+	}
+
+	legs := []Leg{}
+	for _, leg := range raw {
+		if !leg.ride && leg.departs == leg.arrives {
+			continue
+		}
+
+		l := Leg{
+			Mode:     "walk",
+			From:     placeOf(leg.from, from),
+			To:       placeOf(leg.to, to),
+			Departs:  at(leg.departs),
+			Arrives:  at(leg.arrives),
+			Distance: leg.distance,
+		}
+		if leg.ride {
+			trip := tt.trips[leg.trip]
+			l.Mode = "transit"
+			l.TripId = trip.TripId
+			l.RouteId = trip.RouteId
+			l.RouteShortName = trip.RouteShortName
+			l.TripHeadsign = trip.TripHeadsign
+			l.ServiceDate = &trip.ServiceDate
+		}
+		legs = append(legs, l)
+	}
+	return legs
+}
+
+// newItinerary sums up the legs of a journey.
+func newItinerary(feedId string, legs []Leg) Itinerary {
+	itinerary := Itinerary{
+		FeedId:  feedId,
+		Departs: legs[0].Departs,
+		Arrives: legs[len(legs)-1].Arrives,
+		Legs:    legs,
+	}
+	itinerary.Duration = int(itinerary.Arrives.Sub(itinerary.Departs) / time.Second)
+
+	rides := 0
+	for _, leg := range legs {
+		if leg.Mode == "transit" {
+			rides++
+		}
+		itinerary.WalkDistance += leg.Distance
+	}
+	if rides > 1 {
+		itinerary.Transfers = rides - 1
+	}
+	return itinerary
+}
+
+// paretoItineraries keeps the itineraries no other beats on both
+// arrival, or departure when arriving by a time, and transfers. They
+// are returned soonest arriving or latest leaving first.
+func paretoItineraries(all []Itinerary, arriveBy bool) []Itinerary {
+	sort.SliceStable(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if arriveBy && !a.Departs.Equal(b.Departs) {
+			return a.Departs.After(b.Departs)
+		}
+		if !arriveBy && !a.Arrives.Equal(b.Arrives) {
+			return a.Arrives.Before(b.Arrives)
+		}
+		return a.Transfers < b.Transfers
+	})
+
+	kept := []Itinerary{}
+	for _, itinerary := range all {
+		if len(kept) == 0 || itinerary.Transfers < kept[len(kept)-1].Transfers {
+			kept = append(kept, itinerary)
+		}
+	}
+	return kept
+}
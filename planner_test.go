@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParetoItineraries(t *testing.T) {
+	start := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	itinerary := func(departs int, arrives int, transfers int) Itinerary {
+		return Itinerary{
+			Departs:   start.Add(time.Duration(departs) * time.Second),
+			Arrives:   start.Add(time.Duration(arrives) * time.Second),
+			Transfers: transfers,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		all      []Itinerary
+		arriveBy bool
+		kept     []Itinerary
+	}{
+		{
+			name: "soonest arriving first, slower ones only with fewer transfers",
+			all: []Itinerary{
+				itinerary(0, 3000, 0),
+				itinerary(0, 2500, 2),
+				itinerary(0, 2400, 2),
+				itinerary(0, 2400, 1),
+				itinerary(0, 2700, 1),
+			},
+			kept: []Itinerary{
+				itinerary(0, 2400, 1),
+				itinerary(0, 3000, 0),
+			},
+		},
+		{
+			name: "latest leaving first when arriving by a time",
+			all: []Itinerary{
+				itinerary(50, 2400, 0),
+				itinerary(100, 2400, 2),
+				itinerary(100, 2400, 1),
+				itinerary(80, 2400, 3),
+			},
+			arriveBy: true,
+			kept: []Itinerary{
+				itinerary(100, 2400, 1),
+				itinerary(50, 2400, 0),
+			},
+		},
+		{
+			name: "none",
+			all:  []Itinerary{},
+			kept: []Itinerary{},
+		},
+	}
+	for _, test := range tests {
+		if kept := paretoItineraries(test.all, test.arriveBy); !reflect.DeepEqual(kept, test.kept) {
+			t.Errorf("%s: kept %v, want %v", test.name, kept, test.kept)
+		}
+	}
+}
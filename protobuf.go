@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Vector tiles and GTFS-Realtime are protocol buffer messages with few
+// enough fields to read and write by hand. See
+// https://protobuf.dev/programming-guides/encoding/
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated protocol buffer")
+
+func zigzag(n int) uint64 {
+	return uint64(int64(n)<<1 ^ int64(n)>>63)
+}
+
+func protoVarint(out []byte, v uint64) []byte {
+	for v >= 0x80 {
+		out = append(out, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(out, byte(v))
+}
+
+func protoVarintField(out []byte, field int, v uint64) []byte {
+	out = protoVarint(out, uint64(field<<3|wireVarint))
+	return protoVarint(out, v)
+}
+
+func protoBytesField(out []byte, field int, data []byte) []byte {
+	out = protoVarint(out, uint64(field<<3|wireBytes))
+	out = protoVarint(out, uint64(len(data)))
+	return append(out, data...)
+}
+
+func protoPacked(out []byte, field int, values []uint32) []byte {
+	packed := []byte{}
+	for _, v := range values {
+		packed = protoVarint(packed, uint64(v))
+	}
+	return protoBytesField(out, field, packed)
+}
+
+// protoReader reads the fields of a message in turn. The first error
+// ends reading and is kept in err.
+type protoReader struct {
+	data  []byte
+	field int
+	wire  int
+	err   error
+}
+
+// next moves to the next field, telling whether there is one.
+func (r *protoReader) next() bool {
+	if r.err != nil || len(r.data) == 0 {
+		return false
+	}
+	key := r.varint()
+	r.field, r.wire = int(key>>3), int(key&0x7)
+	return r.err == nil
+}
+
+// varint reads a varint value.
+func (r *protoReader) varint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// int reads a varint value of a signed field, int32 or int64.
+func (r *protoReader) int() int64 {
+	return int64(r.varint())
+}
+
+// bytes reads a length-delimited value: a string, bytes or a message.
+func (r *protoReader) bytes() []byte {
+	n := r.varint()
+	if r.err != nil || n > uint64(len(r.data)) {
+		r.fail()
+		return nil
+	}
+	v := r.data[:n]
+	r.data = r.data[n:]
+	return v
+}
+
+// skip passes over the value of a field that is not read.
+func (r *protoReader) skip() {
+	switch r.wire {
+	case wireVarint:
+		r.varint()
+	case wireBytes:
+		r.bytes()
+	case wireFixed64, wireFixed32:
+		n := 8
+		if r.wire == wireFixed32 {
+			n = 4
+		}
+		if len(r.data) < n {
+			r.fail()
+			return
+		}
+		r.data = r.data[n:]
+	default:
+		r.err = errors.New("unsupported protocol buffer wire type")
+	}
+}
+
+func (r *protoReader) fail() {
+	if r.err == nil {
+		r.err = errTruncated
+	}
+}
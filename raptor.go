@@ -0,0 +1,706 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// walkSpeed is how fast journeys walk, in metres a second, along
+	// the straight line between two places.
+	walkSpeed = 1.2
+	// transferDistance is how far apart two stops may be for a journey
+	// to change between them on foot.
+	transferDistance = 400.0
+
+	maxCachedTimetables = 8
+	unreached           = math.MaxInt32
+)
+
+// planTrip is a trip of a timetable, on the service date it runs.
+type planTrip struct {
+	TripId         string
+	RouteId        string
+	RouteShortName string
+	TripHeadsign   string
+	DirectionId    int
+	ShapeId        string
+	ServiceDate    GtfsDate `db:"-"`
+}
+
+// tripRun is one run of a trip along a pattern, its times in seconds
+// from the start of the timetable's service day.
+type tripRun struct {
+	trip       int
+	arrivals   []int
+	departures []int
+	pickup     []bool
+	dropOff    []bool
+}
+
+// pattern is a sequence of stops with the runs along it, ordered so
+// that no run overtakes an earlier one.
+type pattern struct {
+	stops []int
+	runs  []tripRun
+}
+
+// patternStop is the position of a stop on a pattern.
+type patternStop struct {
+	pattern  int
+	position int
+}
+
+// footpath is a walk from one stop to another.
+type footpath struct {
+	to       int
+	duration int
+	distance float64
+}
+
+// timetable is the schedule of one feed for one service day in the form
+// RAPTOR searches: trips grouped in patterns, with the walks between
+// nearby stops. Trips of the previous service day still running after
+// midnight are included, and those of the next one so that journeys
+// late in the day can carry on into the morning. Places are walked to
+// through index, the stops the timetable was built with, so that both
+// come from the same version of the feed.
+type timetable struct {
+	feedId     string
+	start      time.Time
+	stops      []Stop
+	stopIds    map[string]int
+	index      *stopIndex
+	trips      []planTrip
+	patterns   []pattern
+	patternsAt [][]patternStop
+	footpaths  [][]footpath
+
+	reverseOnce sync.Once
+	reverse     *timetable
+}
+
+var (
+	timetablesMutex sync.Mutex
+	// timetables holds the timetable of each feed and day until the feed
+	// is reloaded.
+	timetables = map[string]*timetable{}
+)
+
+// timetableFor returns the timetable of a feed for the service day
+// starting at start, building it on first use.
+func timetableFor(feedId string, start time.Time) (*timetable, error) {
+	key := fmt.Sprintf("%s\x00%d", feedId, start.Unix())
+
+	timetablesMutex.Lock()
+	tt, ok := timetables[key]
+	timetablesMutex.Unlock()
+	if ok {
+		return tt, nil
+	}
+
+	generation := feedGeneration(feedId)
+	started := time.Now()
+	tt, err := buildTimetable(feedId, start)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Built the timetable of feed %s for %s with %d trips in %d patterns in %v",
+		feedId, serviceDate(start), len(tt.trips), len(tt.patterns), time.Since(started))
+
+	timetablesMutex.Lock()
+	if len(timetables) >= maxCachedTimetables {
+		timetables = map[string]*timetable{}
+	}
+	if feedGeneration(feedId) == generation {
+		timetables[key] = tt
+	}
+	timetablesMutex.Unlock()
+	return tt, nil
+}
+
+// forgetTimetables drops the timetables of a feed.
+func forgetTimetables(feedId string) {
+	timetablesMutex.Lock()
+	defer timetablesMutex.Unlock()
+
+	for key, tt := range timetables {
+		if tt.feedId == feedId {
+			delete(timetables, key)
+		}
+	}
+}
+
+// buildTimetable reads the trips of a feed running on the service day
+// starting at start, and the days before and after, from the database.
+func buildTimetable(feedId string, start time.Time) (*timetable, error) {
+	index, err := stopIndexFor(feedId)
+	if err != nil {
+		return nil, err
+	}
+
+	tt := &timetable{
+		feedId:  feedId,
+		start:   start,
+		stops:   index.stops,
+		stopIds: map[string]int{},
+		index:   index,
+	}
+	for i, stop := range tt.stops {
+		tt.stopIds[stop.StopId] = i
+	}
+
+	// Runs are grouped by the stops they call at before being split
+	// into patterns.
+	groups := map[string]int{}
+	groupStops := [][]int{}
+	groupRuns := [][]tripRun{}
+
+	days := []time.Time{
+		serviceDayStart(start.Add(-12 * time.Hour)),
+		start,
+		serviceDayStart(start.Add(36 * time.Hour)),
+	}
+	for _, day := range days {
+		calendars, err := servicesOn(feedId, serviceDayOf(day)(start.Location()))
+		if err != nil {
+			return nil, err
+		}
+		services := newServiceSet(calendars)
+		if services.empty() {
+			continue
+		}
+		params := services.bind(map[string]interface{}{
+			"feed": feedId,
+		})
+
+		trips := []planTrip{}
+		_, err = dbMap.Select(&trips, "select t.tripid, t.routeid, r.routeshortname, t.tripheadsign, t.directionid, t.shapeid from trip t "+
+			"join route r on r.feedid = t.feedid and r.routeid = t.routeid "+
+			"where t.feedid = :feed and (t.feedid, t.serviceid) in "+activeServiceSQL, params)
+		if err != nil {
+			return nil, err
+		}
+
+		stopTimes := []StopTime{}
+		_, err = dbMap.Select(&stopTimes, "select st.* from stoptime st "+
+			"join trip t on t.feedid = st.feedid and t.tripid = st.tripid "+
+			"where st.feedid = :feed and (t.feedid, t.serviceid) in "+activeServiceSQL+" order by st.tripid", params)
+		if err != nil {
+			return nil, err
+		}
+
+		frequencies := []Frequency{}
+		_, err = dbMap.Select(&frequencies, "select f.* from frequency f "+
+			"join trip t on t.feedid = f.feedid and t.tripid = f.tripid "+
+			"where f.feedid = :feed and (t.feedid, t.serviceid) in "+activeServiceSQL, params)
+		if err != nil {
+			return nil, err
+		}
+
+		date := serviceDate(day)
+		tripIds := map[string]int{}
+		for _, trip := range trips {
+			trip.ServiceDate = date
+			tripIds[trip.TripId] = len(tt.trips)
+			tt.trips = append(tt.trips, trip)
+		}
+		headways := map[string][]Frequency{}
+		for _, frequency := range frequencies {
+			headways[frequency.TripId] = append(headways[frequency.TripId], frequency)
+		}
+
+		offset := int(day.Sub(start) / time.Second)
+		for first := 0; first < len(stopTimes); {
+			last := first + 1
+			for last < len(stopTimes) && stopTimes[last].TripId == stopTimes[first].TripId {
+				last++
+			}
+			tripId := stopTimes[first].TripId
+
+			stops, run, ok := tt.runOf(stopTimes[first:last])
+			first = last
+			if !ok {
+				continue
+			}
+			run.trip = tripIds[tripId]
+
+			key := fmt.Sprint(stops)
+			group, ok := groups[key]
+			if !ok {
+				group = len(groupStops)
+				groups[key] = group
+				groupStops = append(groupStops, stops)
+				groupRuns = append(groupRuns, nil)
+			}
+			groupRuns[group] = append(groupRuns[group], repeatRun(run, headways[tripId], offset)...)
+		}
+	}
+
+	for group, stops := range groupStops {
+		tt.addPatterns(stops, groupRuns[group])
+	}
+	tt.indexPatterns()
+
+	transfers := []Transfer{}
+	_, err = dbMap.Select(&transfers, "select * from transfer where feedid = :feed", map[string]interface{}{
+		"feed": feedId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tt.addFootpaths(transfers)
+
+	return tt, nil
+}
+
+// runOf returns the stops a trip calls at and its run along them, with
+// times missing between timed stops interpolated. Trips calling at
+// unknown stops or with fewer than two stops are left out.
+func (tt *timetable) runOf(stopTimes []StopTime) ([]int, tripRun, bool) {
+	sort.SliceStable(stopTimes, func(i, j int) bool {
+		return stopTimes[i].StopSequence < stopTimes[j].StopSequence
+	})
+
+	n := len(stopTimes)
+	if n < 2 {
+		return nil, tripRun{}, false
+	}
+
+	stops := make([]int, n)
+	run := tripRun{
+		arrivals:   make([]int, n),
+		departures: make([]int, n),
+		pickup:     make([]bool, n),
+		dropOff:    make([]bool, n),
+	}
+	timed := []int{}
+	for i, st := range stopTimes {
+		stop, ok := tt.stopIds[st.StopId]
+		if !ok {
+			return nil, tripRun{}, false
+		}
+		stops[i] = stop
+		run.pickup[i] = st.PickupType != "1"
+		run.dropOff[i] = st.DropOffType != "1"
+
+		arrival, departure := st.ArrivalTime, st.DepartureTime
+		if !arrival.Valid() {
+			arrival = departure
+		}
+		if !departure.Valid() {
+			departure = arrival
+		}
+		if arrival.Valid() {
+			run.arrivals[i], run.departures[i] = int(arrival), int(departure)
+			timed = append(timed, i)
+		}
+	}
+	if len(timed) == 0 || timed[0] != 0 || timed[len(timed)-1] != n-1 {
+		return nil, tripRun{}, false
+	}
+
+	for t := 1; t < len(timed); t++ {
+		from, to := timed[t-1], timed[t]
+		for i := from + 1; i < to; i++ {
+			at := run.departures[from] + (run.arrivals[to]-run.departures[from])*(i-from)/(to-from)
+			run.arrivals[i], run.departures[i] = at, at
+		}
+	}
+	return stops, run, true
+}
+
+// repeatRun returns the runs of a trip on a day offset seconds from the
+// timetable's: the trip as scheduled or, for a trip with frequencies,
+// one run per headway.
+func repeatRun(run tripRun, frequencies []Frequency, offset int) []tripRun {
+	if len(frequencies) == 0 {
+		return []tripRun{run.shifted(offset)}
+	}
+
+	runs := []tripRun{}
+	for _, frequency := range frequencies {
+		if frequency.HeadwaySecs <= 0 {
+			continue
+		}
+		for at := int(frequency.StartTime); at < int(frequency.EndTime); at += frequency.HeadwaySecs {
+			runs = append(runs, run.shifted(offset+at-run.departures[0]))
+		}
+	}
+	return runs
+}
+
+// shifted returns a copy of a run seconds later.
+func (run tripRun) shifted(seconds int) tripRun {
+	moved := run
+	moved.arrivals = make([]int, len(run.arrivals))
+	moved.departures = make([]int, len(run.departures))
+	for i := range run.arrivals {
+		moved.arrivals[i] = run.arrivals[i] + seconds
+		moved.departures[i] = run.departures[i] + seconds
+	}
+	return moved
+}
+
+// addPatterns adds the runs along a sequence of stops, as many patterns
+// as it takes for none to overtake another in the same pattern.
+func (tt *timetable) addPatterns(stops []int, runs []tripRun) {
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].departures[0] < runs[j].departures[0]
+	})
+
+	first := len(tt.patterns)
+	for _, run := range runs {
+		placed := false
+		for p := first; p < len(tt.patterns) && !placed; p++ {
+			runs := tt.patterns[p].runs
+			if !run.overtakes(runs[len(runs)-1]) {
+				tt.patterns[p].runs = append(runs, run)
+				placed = true
+			}
+		}
+		if !placed {
+			tt.patterns = append(tt.patterns, pattern{stops: stops, runs: []tripRun{run}})
+		}
+	}
+}
+
+// overtakes tells whether a run arrives or leaves anywhere before an
+// earlier one.
+func (run tripRun) overtakes(earlier tripRun) bool {
+	for i := range run.arrivals {
+		if run.arrivals[i] < earlier.arrivals[i] || run.departures[i] < earlier.departures[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// indexPatterns lists the patterns calling at each stop.
+func (tt *timetable) indexPatterns() {
+	tt.patternsAt = make([][]patternStop, len(tt.stops))
+	for p, pattern := range tt.patterns {
+		for i, stop := range pattern.stops {
+			tt.patternsAt[stop] = append(tt.patternsAt[stop], patternStop{p, i})
+		}
+	}
+}
+
+// addFootpaths links every stop to those within transferDistance, with
+// the minimum times of transfers.txt taking the place of walking times
+// and its forbidden transfers left out.
+func (tt *timetable) addFootpaths(transfers []Transfer) {
+	minimum := map[[2]int]int{}
+	forbidden := map[[2]int]bool{}
+	for _, transfer := range transfers {
+		from, ok := tt.stopIds[transfer.FromStopId]
+		to, found := tt.stopIds[transfer.ToStopId]
+		if !ok || !found || from == to {
+			continue
+		}
+		switch transfer.TransferType {
+		case "2":
+			minimum[[2]int{from, to}] = transfer.MinTransferTime
+		case "3":
+			forbidden[[2]int{from, to}] = true
+		}
+	}
+
+	tt.footpaths = make([][]footpath, len(tt.stops))
+	for from := range tt.stops {
+		for _, near := range tt.index.within(stopPoint(&tt.stops[from]), transferDistance, nil) {
+			to := tt.stopIds[near.StopId]
+			if to == from || forbidden[[2]int{from, to}] {
+				continue
+			}
+			duration := walkSeconds(near.distance)
+			if seconds, ok := minimum[[2]int{from, to}]; ok && seconds > duration {
+				duration = seconds
+			}
+			tt.footpaths[from] = append(tt.footpaths[from], footpath{to, duration, near.distance})
+		}
+	}
+}
+
+// walkSeconds is how long walking a distance in metres takes.
+func walkSeconds(distance float64) int {
+	return int(math.Ceil(distance / walkSpeed))
+}
+
+// reversed returns the timetable run backwards in time, with times
+// negated, patterns reversed and walks turned around, so that a
+// forward search of it finds the latest departures arriving in time.
+func (tt *timetable) reversed() *timetable {
+	tt.reverseOnce.Do(func() {
+		rev := &timetable{
+			feedId:  tt.feedId,
+			start:   tt.start,
+			stops:   tt.stops,
+			stopIds: tt.stopIds,
+			index:   tt.index,
+			trips:   tt.trips,
+		}
+
+		for _, forward := range tt.patterns {
+			n := len(forward.stops)
+			stops := make([]int, n)
+			for i, stop := range forward.stops {
+				stops[n-1-i] = stop
+			}
+
+			runs := make([]tripRun, len(forward.runs))
+			for r, run := range forward.runs {
+				back := tripRun{
+					trip:       run.trip,
+					arrivals:   make([]int, n),
+					departures: make([]int, n),
+					pickup:     make([]bool, n),
+					dropOff:    make([]bool, n),
+				}
+				for i := 0; i < n; i++ {
+					back.arrivals[n-1-i] = -run.departures[i]
+					back.departures[n-1-i] = -run.arrivals[i]
+					back.pickup[n-1-i] = run.dropOff[i]
+					back.dropOff[n-1-i] = run.pickup[i]
+				}
+				runs[r] = back
+			}
+			rev.addPatterns(stops, runs)
+		}
+		rev.indexPatterns()
+
+		rev.footpaths = make([][]footpath, len(tt.stops))
+		for from, paths := range tt.footpaths {
+			for _, path := range paths {
+				rev.footpaths[path.to] = append(rev.footpaths[path.to], footpath{from, path.duration, path.distance})
+			}
+		}
+
+		tt.reverse = rev
+	})
+	return tt.reverse
+}
+
+// stopWalk is a walk between a place and a stop.
+type stopWalk struct {
+	stop     int
+	seconds  int
+	distance float64
+}
+
+const (
+	labelAccess = iota
+	labelRide
+	labelWalk
+)
+
+// label records how a search reached a stop in a round: walking from
+// the origin, riding a run from the stop it boarded at, or walking
+// from the stop a ride alighted at. A walk keeps the ride before it,
+// whose own label a walk to that stop may have replaced.
+type label struct {
+	time    int
+	kind    int
+	from    int
+	pattern int
+	run     int
+	board   int
+	alight  int
+	walk    float64
+}
+
+// searchEnd is a Pareto-optimal way to the destination: the stop left
+// for it on foot after a number of rides, and the arrival time.
+type searchEnd struct {
+	rides int
+	stop  int
+	time  int
+}
+
+// raptor runs the Round-bAsed Public Transit Optimized Router from the
+// origin, left at depart, to the destination, riding at most maxRides
+// times and reaching no stop after until. It returns the labels of
+// every round and the arrivals that are faster than any with fewer
+// rides.
+func (tt *timetable) raptor(depart int, until int, access []stopWalk, egress []stopWalk, maxRides int) ([][]label, []searchEnd) {
+	n := len(tt.stops)
+	newRound := func() []label {
+		round := make([]label, n)
+		for i := range round {
+			round[i].time = unreached
+		}
+		return round
+	}
+
+	best := make([]int, n)
+	for i := range best {
+		best[i] = unreached
+	}
+	isMarked := make([]bool, n)
+	marked := []int{}
+	mark := func(stop int) {
+		if !isMarked[stop] {
+			isMarked[stop] = true
+			marked = append(marked, stop)
+		}
+	}
+
+	labels := [][]label{newRound()}
+	for _, walk := range access {
+		if t := depart + walk.seconds; t < best[walk.stop] && t <= until {
+			labels[0][walk.stop] = label{time: t, kind: labelAccess, walk: walk.distance}
+			best[walk.stop] = t
+			mark(walk.stop)
+		}
+	}
+
+	ends := []searchEnd{}
+	target := unreached
+	if until < unreached {
+		target = until + 1
+	}
+	for k := 1; k <= maxRides && len(marked) > 0; k++ {
+		earliest := append([]int(nil), best...)
+
+		queue := map[int]int{}
+		for _, stop := range marked {
+			isMarked[stop] = false
+			for _, at := range tt.patternsAt[stop] {
+				if position, ok := queue[at.pattern]; !ok || at.position < position {
+					queue[at.pattern] = at.position
+				}
+			}
+		}
+		marked = marked[:0]
+		order := make([]int, 0, len(queue))
+		for p := range queue {
+			order = append(order, p)
+		}
+		sort.Ints(order)
+
+		round := newRound()
+		for _, p := range order {
+			pattern := &tt.patterns[p]
+			run, board := -1, -1
+			for i := queue[p]; i < len(pattern.stops); i++ {
+				stop := pattern.stops[i]
+
+				if run >= 0 && pattern.runs[run].dropOff[i] {
+					if t := pattern.runs[run].arrivals[i]; t < best[stop] && t < target {
+						round[stop] = label{time: t, kind: labelRide, from: pattern.stops[board], pattern: p, run: run, board: board, alight: i}
+						best[stop] = t
+						mark(stop)
+					}
+				}
+
+				if earliest[stop] < unreached && (run < 0 || earliest[stop] <= pattern.runs[run].departures[i]) {
+					if r := pattern.earliestRun(i, earliest[stop]); r >= 0 && (run < 0 || r < run) {
+						run, board = r, i
+					}
+				}
+			}
+		}
+
+		// Walks leave from the rides of the round, even where a walk
+		// to the same stop then replaces the ride's label.
+		rides := append([]label(nil), round...)
+		for _, stop := range append([]int(nil), marked...) {
+			ride := rides[stop]
+			if ride.kind != labelRide {
+				continue
+			}
+			for _, path := range tt.footpaths[stop] {
+				if t := ride.time + path.duration; t < best[path.to] && t < target {
+					walk := ride
+					walk.time, walk.kind, walk.from, walk.walk = t, labelWalk, stop, path.distance
+					round[path.to] = walk
+					best[path.to] = t
+					mark(path.to)
+				}
+			}
+		}
+		labels = append(labels, round)
+
+		end := searchEnd{rides: k, time: unreached}
+		for _, walk := range egress {
+			if round[walk.stop].time < unreached && round[walk.stop].time+walk.seconds < end.time {
+				end.stop, end.time = walk.stop, round[walk.stop].time+walk.seconds
+			}
+		}
+		if end.time < target {
+			target = end.time
+			ends = append(ends, end)
+		}
+	}
+
+	return labels, ends
+}
+
+// earliestRun returns the first run that can be boarded at position i
+// at or after time t, or -1.
+func (pattern *pattern) earliestRun(i int, t int) int {
+	r := sort.Search(len(pattern.runs), func(r int) bool {
+		return pattern.runs[r].departures[i] >= t
+	})
+	for ; r < len(pattern.runs); r++ {
+		if pattern.runs[r].pickup[i] {
+			return r
+		}
+	}
+	return -1
+}
+
+// rawLeg is one leg of a journey found by a search, between stops and
+// times of the searched timetable; the first and last legs walk from
+// and to the places searched between, from or to is then -1.
+type rawLeg struct {
+	ride     bool
+	from     int
+	to       int
+	departs  int
+	arrives  int
+	trip     int
+	distance float64
+}
+
+// legs follows the labels of a search back from one of its ends,
+// returning the legs of the journey in order. The walk to the
+// destination is left to the caller.
+func (tt *timetable) legs(labels [][]label, end searchEnd) []rawLeg {
+	legs := []rawLeg{}
+
+	k, stop := end.rides, end.stop
+	for {
+		l := labels[k][stop]
+		switch l.kind {
+		case labelAccess:
+			legs = append(legs, rawLeg{from: -1, to: stop, arrives: l.time, distance: l.walk})
+			for i, j := 0, len(legs)-1; i < j; i, j = i+1, j-1 {
+				legs[i], legs[j] = legs[j], legs[i]
+			}
+			return legs
+		case labelWalk, labelRide:
+			pattern := &tt.patterns[l.pattern]
+			run := pattern.runs[l.run]
+			if l.kind == labelWalk {
+				legs = append(legs, rawLeg{from: l.from, to: stop, departs: run.arrivals[l.alight], arrives: l.time, distance: l.walk})
+				stop = l.from
+			}
+			legs = append(legs, rawLeg{
+				ride:    true,
+				from:    pattern.stops[l.board],
+				to:      stop,
+				departs: run.departures[l.board],
+				arrives: run.arrivals[l.alight],
+				trip:    run.trip,
+			})
+			stop = pattern.stops[l.board]
+			for k--; labels[k][stop].time == unreached; k-- {
+			}
+		}
+	}
+}
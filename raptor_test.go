@@ -0,0 +1,309 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testTrip is a trip of a test timetable: the stops it calls at and the
+// times it arrives and leaves, NoTime for untimed stops.
+type testTrip struct {
+	id    string
+	stops []string
+	times []GtfsTime
+}
+
+// testTimetable builds a timetable of stops A to G running north, C and D
+// 100 m apart, F 345 m beyond D and the rest about 11 km from each
+// other, as buildTimetable would from the trips given.
+func testTimetable(t *testing.T, trips ...testTrip) *timetable {
+	stops := []Stop{
+		{FeedId: "test", StopId: "A", StopName: "A", StopLat: 45.0, StopLon: -75.0},
+		{FeedId: "test", StopId: "B", StopName: "B", StopLat: 45.1, StopLon: -75.0},
+		{FeedId: "test", StopId: "C", StopName: "C", StopLat: 45.2, StopLon: -75.0},
+		{FeedId: "test", StopId: "D", StopName: "D", StopLat: 45.2009, StopLon: -75.0},
+		{FeedId: "test", StopId: "E", StopName: "E", StopLat: 45.3, StopLon: -75.0},
+		{FeedId: "test", StopId: "F", StopName: "F", StopLat: 45.2040, StopLon: -75.0},
+		{FeedId: "test", StopId: "G", StopName: "G", StopLat: 45.4, StopLon: -75.0},
+	}
+	index := newStopIndex(stops)
+
+	tt := &timetable{
+		feedId:  "test",
+		start:   time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC),
+		stops:   index.stops,
+		stopIds: map[string]int{},
+		index:   index,
+	}
+	for i, stop := range tt.stops {
+		tt.stopIds[stop.StopId] = i
+	}
+
+	for _, trip := range trips {
+		stopTimes := []StopTime{}
+		for i, stopId := range trip.stops {
+			stopTimes = append(stopTimes, StopTime{
+				TripId:        trip.id,
+				StopId:        stopId,
+				StopSequence:  i + 1,
+				ArrivalTime:   trip.times[i],
+				DepartureTime: trip.times[i],
+			})
+		}
+		stops, run, ok := tt.runOf(stopTimes)
+		if !ok {
+			t.Fatalf("trip %s left out", trip.id)
+		}
+		run.trip = len(tt.trips)
+		tt.trips = append(tt.trips, planTrip{TripId: trip.id, RouteId: trip.id})
+		tt.addPatterns(stops, []tripRun{run})
+	}
+	tt.indexPatterns()
+	tt.addFootpaths(nil)
+	return tt
+}
+
+func TestRunOf(t *testing.T) {
+	tt := testTimetable(t)
+
+	tests := []struct {
+		name       string
+		stopTimes  []StopTime
+		stops      []string
+		arrivals   []int
+		departures []int
+		pickup     []bool
+		ok         bool
+	}{
+		{
+			name: "timed",
+			stopTimes: []StopTime{
+				{StopId: "A", StopSequence: 1, ArrivalTime: 100, DepartureTime: 120},
+				{StopId: "B", StopSequence: 2, ArrivalTime: 200, DepartureTime: 200},
+			},
+			stops:      []string{"A", "B"},
+			arrivals:   []int{100, 200},
+			departures: []int{120, 200},
+			pickup:     []bool{true, true},
+			ok:         true,
+		},
+		{
+			name: "untimed stops interpolated from the departure before",
+			stopTimes: []StopTime{
+				{StopId: "A", StopSequence: 1, ArrivalTime: 100, DepartureTime: 130},
+				{StopId: "B", StopSequence: 2, ArrivalTime: NoTime, DepartureTime: NoTime},
+				{StopId: "C", StopSequence: 3, ArrivalTime: NoTime, DepartureTime: NoTime},
+				{StopId: "E", StopSequence: 4, ArrivalTime: 430, DepartureTime: NoTime},
+			},
+			stops:      []string{"A", "B", "C", "E"},
+			arrivals:   []int{100, 230, 330, 430},
+			departures: []int{130, 230, 330, 430},
+			pickup:     []bool{true, true, true, true},
+			ok:         true,
+		},
+		{
+			name: "ordered by stop sequence",
+			stopTimes: []StopTime{
+				{StopId: "C", StopSequence: 30, ArrivalTime: 300, DepartureTime: 300},
+				{StopId: "A", StopSequence: 10, ArrivalTime: 100, DepartureTime: 100, PickupType: "1"},
+				{StopId: "B", StopSequence: 20, ArrivalTime: 200, DepartureTime: 200},
+			},
+			stops:      []string{"A", "B", "C"},
+			arrivals:   []int{100, 200, 300},
+			departures: []int{100, 200, 300},
+			pickup:     []bool{false, true, true},
+			ok:         true,
+		},
+		{
+			name: "first stop untimed",
+			stopTimes: []StopTime{
+				{StopId: "A", StopSequence: 1, ArrivalTime: NoTime, DepartureTime: NoTime},
+				{StopId: "B", StopSequence: 2, ArrivalTime: 200, DepartureTime: 200},
+			},
+		},
+		{
+			name: "unknown stop",
+			stopTimes: []StopTime{
+				{StopId: "A", StopSequence: 1, ArrivalTime: 100, DepartureTime: 100},
+				{StopId: "Z", StopSequence: 2, ArrivalTime: 200, DepartureTime: 200},
+			},
+		},
+		{
+			name: "one stop",
+			stopTimes: []StopTime{
+				{StopId: "A", StopSequence: 1, ArrivalTime: 100, DepartureTime: 100},
+			},
+		},
+	}
+	for _, test := range tests {
+		stops, run, ok := tt.runOf(test.stopTimes)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		stopIds := []string{}
+		for _, stop := range stops {
+			stopIds = append(stopIds, tt.stops[stop].StopId)
+		}
+		if !reflect.DeepEqual(stopIds, test.stops) {
+			t.Errorf("%s: stops = %v, want %v", test.name, stopIds, test.stops)
+		}
+		if !reflect.DeepEqual(run.arrivals, test.arrivals) || !reflect.DeepEqual(run.departures, test.departures) {
+			t.Errorf("%s: arrivals %v, departures %v, want %v, %v", test.name, run.arrivals, run.departures, test.arrivals, test.departures)
+		}
+		if !reflect.DeepEqual(run.pickup, test.pickup) {
+			t.Errorf("%s: pickup = %v, want %v", test.name, run.pickup, test.pickup)
+		}
+	}
+}
+
+func TestAddPatternsNeverOvertakes(t *testing.T) {
+	run := func(trip int, times ...int) tripRun {
+		return tripRun{
+			trip:       trip,
+			arrivals:   times,
+			departures: times,
+			pickup:     []bool{true, true, true},
+			dropOff:    []bool{true, true, true},
+		}
+	}
+	runs := []tripRun{
+		run(0, 400, 500, 600),
+		run(1, 100, 200, 300),
+		// An express leaving after trip 1 and arriving before it.
+		run(2, 150, 220, 280),
+		run(3, 160, 230, 290),
+	}
+
+	tt := &timetable{}
+	tt.addPatterns([]int{0, 1, 2}, runs)
+
+	trips := [][]int{}
+	for _, pattern := range tt.patterns {
+		ids := []int{}
+		for i, r := range pattern.runs {
+			if i > 0 && r.overtakes(pattern.runs[i-1]) {
+				t.Errorf("trip %d overtakes trip %d", r.trip, pattern.runs[i-1].trip)
+			}
+			ids = append(ids, r.trip)
+		}
+		trips = append(trips, ids)
+	}
+	if want := [][]int{{1, 0}, {2, 3}}; !reflect.DeepEqual(trips, want) {
+		t.Errorf("patterns hold trips %v, want %v", trips, want)
+	}
+}
+
+func TestJourneys(t *testing.T) {
+	tt := testTimetable(t,
+		testTrip{"slow", []string{"A", "D"}, []GtfsTime{50, 1300}},
+		testTrip{"early", []string{"A", "B", "C"}, []GtfsTime{100, 600, 1100}},
+		testTrip{"late", []string{"A", "B", "C"}, []GtfsTime{1000, 1500, 2000}},
+		testTrip{"connection", []string{"D", "E"}, []GtfsTime{1400, 2400}},
+		testTrip{"direct", []string{"A", "E"}, []GtfsTime{200, 3000}},
+		testTrip{"onward", []string{"F", "G"}, []GtfsTime{1600, 2600}},
+	)
+	at := func(seconds int) time.Time {
+		return tt.start.Add(time.Duration(seconds) * time.Second)
+	}
+	stop := func(stopId string) planPlace {
+		return planPlace{stopId: stopId}
+	}
+
+	type leg struct {
+		mode     string
+		from, to string
+		departs  int
+		arrives  int
+		tripId   string
+	}
+	tests := []struct {
+		name        string
+		from, to    string
+		at          int
+		arriveBy    bool
+		itineraries [][]leg
+	}{
+		{
+			name: "direct ride",
+			from: "A", to: "C", at: 0,
+			itineraries: [][]leg{
+				{{"transit", "A", "C", 100, 1100, "early"}},
+			},
+		},
+		{
+			name: "one transfer, faster than the direct ride",
+			from: "A", to: "E", at: 0,
+			itineraries: [][]leg{
+				{{"transit", "A", "E", 200, 3000, "direct"}},
+				{
+					{"transit", "A", "C", 100, 1100, "early"},
+					{"walk", "C", "D", 1100, 1184, ""},
+					{"transit", "D", "E", 1400, 2400, "connection"},
+				},
+			},
+		},
+		{
+			name: "arriving by a time",
+			from: "A", to: "E", at: 2500, arriveBy: true,
+			itineraries: [][]leg{
+				{
+					{"transit", "A", "C", 100, 1100, "early"},
+					{"walk", "C", "D", 1100, 1184, ""},
+					{"transit", "D", "E", 1400, 2400, "connection"},
+				},
+			},
+		},
+		{
+			name: "arriving by a time, the latest ride",
+			from: "A", to: "C", at: 2100, arriveBy: true,
+			itineraries: [][]leg{
+				{{"transit", "A", "C", 1000, 2000, "late"}},
+			},
+		},
+		{
+			// Walking from C reaches D before the slow trip does, but
+			// only the ride there can walk on to F.
+			name: "walking on from a ride a walk beats",
+			from: "A", to: "G", at: 0,
+			itineraries: [][]leg{
+				{
+					{"transit", "A", "D", 50, 1300, "slow"},
+					{"walk", "D", "F", 1300, 1588, ""},
+					{"transit", "F", "G", 1600, 2600, "onward"},
+				},
+			},
+		},
+		{
+			name: "too late",
+			from: "A", to: "E", at: 1500,
+			itineraries: [][]leg{},
+		},
+	}
+	for _, test := range tests {
+		itineraries := tt.journeys(stop(test.from), stop(test.to), at(test.at), test.arriveBy, defaultPlanWalk, maxPlanTransfers+1)
+
+		got := [][]leg{}
+		for _, itinerary := range itineraries {
+			legs := []leg{}
+			for _, l := range itinerary.Legs {
+				legs = append(legs, leg{
+					mode:    l.Mode,
+					from:    l.From.StopId,
+					to:      l.To.StopId,
+					departs: int(l.Departs.Sub(tt.start) / time.Second),
+					arrives: int(l.Arrives.Sub(tt.start) / time.Second),
+					tripId:  l.TripId,
+				})
+			}
+			got = append(got, legs)
+		}
+		if !reflect.DeepEqual(got, test.itineraries) {
+			t.Errorf("%s: itineraries\n%v\nwant\n%v", test.name, got, test.itineraries)
+		}
+	}
+}
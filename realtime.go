@@ -0,0 +1,753 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRealtimeInterval is how often TripUpdates are polled unless
+	// a source says otherwise.
+	defaultRealtimeInterval = 30 * time.Second
+	minRealtimeInterval     = 5 * time.Second
+	realtimeFetchTimeout    = 20 * time.Second
+	// realtimeMaxAge is how long TripUpdates are overlaid on schedules
+	// after they were received.
+	realtimeMaxAge = 10 * time.Minute
+	// realtimeWindow is how far from when it was received a TripUpdate
+	// without a start date applies to the runs of its trip.
+	realtimeWindow = 12 * time.Hour
+)
+
+// Values of the GTFS-Realtime enums read. See
+// https://gtfs.org/documentation/realtime/reference/
+const (
+	rtDifferential = 1
+
+	rtTripCanceled = 3
+	rtTripDeleted  = 7
+
+	rtStopSkipped = 1
+	rtStopNoData  = 2
+)
+
+// realtimeEvent is the predicted arrival or departure at a stop, as a
+// delay in seconds or an instant.
+type realtimeEvent struct {
+	delay    int
+	hasDelay bool
+	time     int64
+}
+
+// delayFrom returns the delay of an event from a scheduled instant,
+// telling whether it is known.
+func (event realtimeEvent) delayFrom(scheduled *time.Time) (int, bool) {
+	if event.hasDelay {
+		return event.delay, true
+	}
+	if event.time != 0 && scheduled != nil {
+		return int(event.time - scheduled.Unix()), true
+	}
+	return 0, false
+}
+
+// realtimeStop is the update of one stop of a trip, matched by stop
+// sequence or, when it has none, by stop ID.
+type realtimeStop struct {
+	stopSequence int
+	stopId       string
+	arrival      realtimeEvent
+	departure    realtimeEvent
+	relationship int
+}
+
+// realtimeTrip is the latest TripUpdate of one run of a trip, the run
+// starting on startDate when it is given.
+type realtimeTrip struct {
+	tripId    string
+	startDate string
+	canceled  bool
+	delay     int
+	hasDelay  bool
+	stops     []realtimeStop
+}
+
+// realtimeFeed is the TripUpdates held for a feed, by trip ID.
+type realtimeFeed struct {
+	trips     map[string][]realtimeTrip
+	timestamp time.Time
+	received  time.Time
+}
+
+// realtimeSource is a URL or file polled for the TripUpdates of a feed.
+type realtimeSource struct {
+	source    string
+	interval  time.Duration
+	stop      chan struct{}
+	lastError string
+}
+
+var (
+	realtimeMutex sync.Mutex
+	// realtimeFeeds holds the latest TripUpdates of each feed. A feed is
+	// replaced rather than changed, so readers may keep using one.
+	realtimeFeeds   = map[string]*realtimeFeed{}
+	realtimeSources = map[string]*realtimeSource{}
+)
+
+// RealtimeStatus describes the TripUpdates held for a feed and the
+// source they are polled from.
+type RealtimeStatus struct {
+	FeedId    string     `json:"feed_id"`
+	Source    string     `json:"source,omitempty"`
+	Interval  string     `json:"interval,omitempty"`
+	Trips     int        `json:"trips"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Received  *time.Time `json:"received,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// PushRealtime stores a GTFS-Realtime FeedMessage of TripUpdates posted
+// as the body, for the feed given or the default one.
+func (serv TransitService) PushRealtime(body string, feed string) {
+	if feed == "" {
+		feed = defaultFeed
+	}
+	if _, err := feedIdsFor(feed); err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return
+	}
+
+	if err := ingestRealtime(feed, []byte(body), nil); err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return
+	}
+	serv.writeRealtimeStatus(feed)
+}
+
+// PollRealtime polls the URL or file posted as the body for the
+// TripUpdates of a feed every interval, a duration such as "30s" or a
+// number of seconds, in place of any source it had. An empty body stops
+// polling. The first poll is made right away.
+func (serv TransitService) PollRealtime(source string, feed string, interval string) {
+	if feed == "" {
+		feed = defaultFeed
+	}
+	if _, err := feedIdsFor(feed); err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return
+	}
+
+	every := defaultRealtimeInterval
+	if interval != "" {
+		var err error
+		if every, err = time.ParseDuration(interval); err != nil {
+			seconds, atoiErr := strconv.Atoi(interval)
+			every, err = time.Duration(seconds)*time.Second, atoiErr
+		}
+		if err != nil || every < minRealtimeInterval {
+			serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid interval %q, expected at least %v", interval, minRealtimeInterval)))
+			return
+		}
+	}
+
+	source = strings.TrimSpace(source)
+	if source == "" {
+		unwatchRealtime(feed)
+	} else if err := watchRealtime(feed, source, every); err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return
+	}
+	serv.writeRealtimeStatus(feed)
+}
+
+// RealtimeStatus lists the feeds with TripUpdates or a source of them.
+func (serv TransitService) RealtimeStatus() []RealtimeStatus {
+	realtimeMutex.Lock()
+	feedIds := []string{}
+	for feedId := range realtimeFeeds {
+		feedIds = append(feedIds, feedId)
+	}
+	for feedId := range realtimeSources {
+		if _, ok := realtimeFeeds[feedId]; !ok {
+			feedIds = append(feedIds, feedId)
+		}
+	}
+	realtimeMutex.Unlock()
+	sort.Strings(feedIds)
+
+	all := []RealtimeStatus{}
+	for _, feedId := range feedIds {
+		all = append(all, realtimeStatusOf(feedId))
+	}
+	return all
+}
+
+// writeRealtimeStatus responds with the realtime status of a feed.
+func (serv TransitService) writeRealtimeStatus(feedId string) {
+	body, err := json.Marshal(realtimeStatusOf(feedId))
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return
+	}
+	serv.ResponseBuilder().SetContentType("application/json").WriteAndOveride(body)
+}
+
+func realtimeStatusOf(feedId string) RealtimeStatus {
+	realtimeMutex.Lock()
+	defer realtimeMutex.Unlock()
+
+	status := RealtimeStatus{FeedId: feedId}
+	if feed, ok := realtimeFeeds[feedId]; ok {
+		for _, runs := range feed.trips {
+			status.Trips += len(runs)
+		}
+		if !feed.timestamp.IsZero() {
+			status.Timestamp = &feed.timestamp
+		}
+		status.Received = &feed.received
+	}
+	if source, ok := realtimeSources[feedId]; ok {
+		status.Source = source.source
+		status.Interval = source.interval.String()
+		status.LastError = source.lastError
+	}
+	return status
+}
+
+// watchRealtime polls a source for the TripUpdates of a feed, now and
+// every interval of at least minRealtimeInterval, in place of any source
+// the feed had.
+func watchRealtime(feedId string, source string, interval time.Duration) error {
+	if interval < minRealtimeInterval {
+		return fmt.Errorf("invalid realtime interval %v, expected at least %v", interval, minRealtimeInterval)
+	}
+	watched := &realtimeSource{
+		source:   source,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+
+	realtimeMutex.Lock()
+	if previous, ok := realtimeSources[feedId]; ok {
+		close(previous.stop)
+	}
+	realtimeSources[feedId] = watched
+	realtimeMutex.Unlock()
+
+	watched.poll(feedId)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-watched.stop:
+				return
+			case <-ticker.C:
+				watched.poll(feedId)
+			}
+		}
+	}()
+	return nil
+}
+
+// unwatchRealtime stops polling for the TripUpdates of a feed.
+func unwatchRealtime(feedId string) {
+	realtimeMutex.Lock()
+	defer realtimeMutex.Unlock()
+
+	if watched, ok := realtimeSources[feedId]; ok {
+		close(watched.stop)
+		delete(realtimeSources, feedId)
+	}
+}
+
+// poll reads the source once, keeping the error if it fails.
+func (watched *realtimeSource) poll(feedId string) {
+	data, err := readRealtime(watched.source)
+	if err == nil {
+		err = ingestRealtime(feedId, data, watched)
+	}
+
+	realtimeMutex.Lock()
+	watched.lastError = ""
+	if err != nil {
+		watched.lastError = err.Error()
+	}
+	realtimeMutex.Unlock()
+
+	if err != nil {
+		log.Println("Polling realtime for feed", feedId, "from", watched.source, "failed.", err)
+	}
+}
+
+// readRealtime fetches a FeedMessage from a URL or reads it from a file.
+func readRealtime(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+
+	client := http.Client{Timeout: realtimeFetchTimeout}
+	response, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", source, response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// ingestRealtime stores the TripUpdates of a FeedMessage for a feed. A
+// full dataset replaces those held; a differential one replaces the runs
+// it updates and drops the trips it deletes. A message read from a
+// source is dropped if the source stopped being polled meanwhile.
+func ingestRealtime(feedId string, data []byte, from *realtimeSource) error {
+	message, err := decodeTripUpdates(data)
+	if err != nil {
+		return err
+	}
+
+	realtimeMutex.Lock()
+	defer realtimeMutex.Unlock()
+
+	if from != nil && realtimeSources[feedId] != from {
+		return nil
+	}
+
+	trips := map[string][]realtimeTrip{}
+	if current, ok := realtimeFeeds[feedId]; ok && message.differential {
+		for tripId, runs := range current.trips {
+			trips[tripId] = runs
+		}
+	}
+	for _, tripId := range message.deleted {
+		delete(trips, tripId)
+	}
+	for _, trip := range message.trips {
+		runs := []realtimeTrip{}
+		for _, run := range trips[trip.tripId] {
+			if run.startDate != trip.startDate {
+				runs = append(runs, run)
+			}
+		}
+		trips[trip.tripId] = append(runs, trip)
+	}
+
+	realtimeFeeds[feedId] = &realtimeFeed{
+		trips:     trips,
+		timestamp: message.timestamp,
+		received:  time.Now(),
+	}
+	return nil
+}
+
+// realtimeMessage is what tamer reads of a FeedMessage: its TripUpdates
+// and, for a differential one, the trips it deletes.
+type realtimeMessage struct {
+	differential bool
+	timestamp    time.Time
+	trips        []realtimeTrip
+	deleted      []string
+}
+
+// decodeTripUpdates reads the TripUpdates of a FeedMessage, skipping
+// every other kind of entity.
+func decodeTripUpdates(data []byte) (*realtimeMessage, error) {
+	message := &realtimeMessage{}
+
+	r := &protoReader{data: data}
+	for r.next() {
+		switch {
+		case r.field == 1 && r.wire == wireBytes:
+			header := &protoReader{data: r.bytes()}
+			for header.next() {
+				switch {
+				case header.field == 2 && header.wire == wireVarint:
+					message.differential = header.varint() == rtDifferential
+				case header.field == 3 && header.wire == wireVarint:
+					message.timestamp = time.Unix(header.int(), 0)
+				default:
+					header.skip()
+				}
+			}
+			if header.err != nil {
+				return nil, header.err
+			}
+		case r.field == 2 && r.wire == wireBytes:
+			if err := message.decodeEntity(r.bytes()); err != nil {
+				return nil, err
+			}
+		default:
+			r.skip()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return message, nil
+}
+
+// decodeEntity reads a FeedEntity, keeping its TripUpdate if it has one
+// naming a trip. Updates of trips missing from the schedule are kept
+// too; they never match a stop time.
+func (message *realtimeMessage) decodeEntity(data []byte) error {
+	var trip *realtimeTrip
+	deleted := false
+
+	r := &protoReader{data: data}
+	for r.next() {
+		switch {
+		case r.field == 2 && r.wire == wireVarint:
+			deleted = r.varint() != 0
+		case r.field == 3 && r.wire == wireBytes:
+			decoded, err := decodeTripUpdate(r.bytes())
+			if err != nil {
+				return err
+			}
+			trip = decoded
+		default:
+			r.skip()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	if trip == nil || trip.tripId == "" {
+		return nil
+	}
+	if deleted {
+		message.deleted = append(message.deleted, trip.tripId)
+	} else {
+		message.trips = append(message.trips, *trip)
+	}
+	return nil
+}
+
+// decodeTripUpdate reads a TripUpdate and its TripDescriptor.
+func decodeTripUpdate(data []byte) (*realtimeTrip, error) {
+	trip := &realtimeTrip{}
+
+	r := &protoReader{data: data}
+	for r.next() {
+		switch {
+		case r.field == 1 && r.wire == wireBytes:
+			descriptor := &protoReader{data: r.bytes()}
+			for descriptor.next() {
+				switch {
+				case descriptor.field == 1 && descriptor.wire == wireBytes:
+					trip.tripId = string(descriptor.bytes())
+				case descriptor.field == 3 && descriptor.wire == wireBytes:
+					trip.startDate = string(descriptor.bytes())
+				case descriptor.field == 4 && descriptor.wire == wireVarint:
+					relationship := descriptor.varint()
+					trip.canceled = relationship == rtTripCanceled || relationship == rtTripDeleted
+				default:
+					descriptor.skip()
+				}
+			}
+			if descriptor.err != nil {
+				return nil, descriptor.err
+			}
+		case r.field == 2 && r.wire == wireBytes:
+			stop, err := decodeStopTimeUpdate(r.bytes())
+			if err != nil {
+				return nil, err
+			}
+			trip.stops = append(trip.stops, stop)
+		case r.field == 5 && r.wire == wireVarint:
+			trip.delay, trip.hasDelay = int(int32(r.int())), true
+		default:
+			r.skip()
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return trip, nil
+}
+
+// decodeStopTimeUpdate reads a StopTimeUpdate.
+func decodeStopTimeUpdate(data []byte) (realtimeStop, error) {
+	stop := realtimeStop{stopSequence: -1}
+
+	r := &protoReader{data: data}
+	for r.next() {
+		switch {
+		case r.field == 1 && r.wire == wireVarint:
+			stop.stopSequence = int(r.varint())
+		case r.field == 4 && r.wire == wireBytes:
+			stop.stopId = string(r.bytes())
+		case r.field == 2 && r.wire == wireBytes:
+			stop.arrival = decodeStopTimeEvent(r.bytes(), r)
+		case r.field == 3 && r.wire == wireBytes:
+			stop.departure = decodeStopTimeEvent(r.bytes(), r)
+		case r.field == 5 && r.wire == wireVarint:
+			stop.relationship = int(r.varint())
+		default:
+			r.skip()
+		}
+	}
+	return stop, r.err
+}
+
+// decodeStopTimeEvent reads a StopTimeEvent, failing parent on errors.
+func decodeStopTimeEvent(data []byte, parent *protoReader) realtimeEvent {
+	event := realtimeEvent{}
+
+	r := &protoReader{data: data}
+	for r.next() {
+		switch {
+		case r.field == 1 && r.wire == wireVarint:
+			event.delay, event.hasDelay = int(int32(r.int())), true
+		case r.field == 2 && r.wire == wireVarint:
+			event.time = r.int()
+		default:
+			r.skip()
+		}
+	}
+	if r.err != nil && parent.err == nil {
+		parent.err = r.err
+	}
+	return event
+}
+
+// realtimeFor returns the TripUpdates of a feed, or nil when it has
+// none received within realtimeMaxAge.
+func realtimeFor(feedId string) *realtimeFeed {
+	realtimeMutex.Lock()
+	feed := realtimeFeeds[feedId]
+	realtimeMutex.Unlock()
+
+	if feed == nil || time.Since(feed.received) > realtimeMaxAge {
+		return nil
+	}
+	return feed
+}
+
+// runOf returns the update of the run of a trip on a service date, if
+// there is one. Updates without a start date apply to runs scheduled
+// within realtimeWindow of when they were received.
+func (feed *realtimeFeed) runOf(tripId string, date GtfsDate, scheduled *time.Time) *realtimeTrip {
+	runs := feed.trips[tripId]
+	for i := range runs {
+		if runs[i].startDate != "" {
+			if runs[i].startDate == date.Format("20060102") {
+				return &runs[i]
+			}
+			continue
+		}
+		if scheduled != nil && scheduled.Sub(feed.received) < realtimeWindow && feed.received.Sub(*scheduled) < realtimeWindow {
+			return &runs[i]
+		}
+	}
+	return nil
+}
+
+// placeUpdatedTrips places unplaced stop times of trips with realtime
+// updates on the service day of the update, or today when it has no
+// start date, so that predictions can be overlaid on them.
+func placeUpdatedTrips(all []StopTime) {
+	for i := range all {
+		st := &all[i]
+		feed := realtimeFor(st.FeedId)
+		if st.ServiceDate != nil || feed == nil || len(feed.trips[st.TripId]) == 0 {
+			continue
+		}
+
+		loc := feedLocation(st.FeedId)
+		start := serviceDayStart(time.Now().In(loc))
+		if day, err := parseGtfsDate(feed.trips[st.TripId][0].startDate); err == nil {
+			start = serviceDayStart(onDate(day)(loc))
+		}
+		st.placeOn(start)
+	}
+}
+
+// overlayRealtime sets the predictions of the latest TripUpdates on
+// placed stop times. The rest of the stop times of each updated trip
+// are read too, so delays carry on from the stops they were given for.
+func overlayRealtime(all []StopTime) error {
+	type run struct {
+		feedId string
+		tripId string
+		date   string
+	}
+	updates := map[run]*realtimeTrip{}
+	tripIds := map[string]textArray{}
+
+	for i := range all {
+		st := &all[i]
+		if st.ServiceDate == nil {
+			continue
+		}
+		feed := realtimeFor(st.FeedId)
+		if feed == nil {
+			continue
+		}
+		scheduled := st.DepartsAt
+		if scheduled == nil {
+			scheduled = st.ArrivesAt
+		}
+		trip := feed.runOf(st.TripId, *st.ServiceDate, scheduled)
+		if trip == nil {
+			continue
+		}
+
+		key := run{st.FeedId, st.TripId, st.ServiceDate.Format("20060102")}
+		if _, ok := updates[key]; !ok {
+			updates[key] = trip
+			tripIds[st.FeedId] = append(tripIds[st.FeedId], st.TripId)
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	predicted := map[run]map[int]StopTime{}
+	for feedId, ids := range tripIds {
+		stopTimes := []StopTime{}
+		_, err := dbMap.Select(&stopTimes, "select * from stoptime where feedid = :feed and tripid = any(cast(:trips as text[]))", map[string]interface{}{
+			"feed":  feedId,
+			"trips": ids,
+		})
+		if err != nil {
+			return err
+		}
+		stopTimesOf := map[string][]StopTime{}
+		for _, st := range stopTimes {
+			stopTimesOf[st.TripId] = append(stopTimesOf[st.TripId], st)
+		}
+
+		for key, trip := range updates {
+			if key.feedId != feedId {
+				continue
+			}
+			day, _ := parseGtfsDate(key.date)
+			start := serviceDayStart(onDate(day)(feedLocation(feedId)))
+
+			rows := append([]StopTime(nil), stopTimesOf[key.tripId]...)
+			sort.SliceStable(rows, func(i, j int) bool {
+				return rows[i].StopSequence < rows[j].StopSequence
+			})
+			for i := range rows {
+				rows[i].placeOn(start)
+			}
+			trip.predict(rows)
+
+			predicted[key] = map[int]StopTime{}
+			for _, row := range rows {
+				predicted[key][row.StopSequence] = row
+			}
+		}
+	}
+
+	for i := range all {
+		st := &all[i]
+		if st.ServiceDate == nil {
+			continue
+		}
+		row, ok := predicted[run{st.FeedId, st.TripId, st.ServiceDate.Format("20060102")}][st.StopSequence]
+		if !ok {
+			continue
+		}
+		st.PredictedArrival = row.PredictedArrival
+		st.PredictedDeparture = row.PredictedDeparture
+		st.Delay = row.Delay
+		st.ScheduleRelationship = row.ScheduleRelationship
+	}
+	return nil
+}
+
+// predict sets the realtime fields of the placed stop times of a trip's
+// run, in stop sequence order. As GTFS-Realtime has it, a delay carries
+// on to the following stops until another update or one without data.
+func (trip *realtimeTrip) predict(rows []StopTime) {
+	if trip.canceled {
+		for i := range rows {
+			rows[i].ScheduleRelationship = "CANCELED"
+		}
+		return
+	}
+
+	delay, known := trip.delay, trip.hasDelay
+	for i := range rows {
+		st := &rows[i]
+		update := trip.stopUpdate(st)
+		if update == nil {
+			if known {
+				st.setDelays(delay, delay)
+			}
+			continue
+		}
+
+		switch update.relationship {
+		case rtStopSkipped:
+			st.ScheduleRelationship = "SKIPPED"
+			continue
+		case rtStopNoData:
+			st.ScheduleRelationship = "NO_DATA"
+			known = false
+			continue
+		}
+
+		arrival, arrivalKnown := update.arrival.delayFrom(st.ArrivesAt)
+		departure, departureKnown := update.departure.delayFrom(st.DepartsAt)
+		switch {
+		case arrivalKnown && !departureKnown:
+			departure = arrival
+		case departureKnown && !arrivalKnown:
+			arrival = departure
+		case !arrivalKnown && !departureKnown:
+			if !known {
+				continue
+			}
+			arrival, departure = delay, delay
+		}
+		st.setDelays(arrival, departure)
+		delay, known = departure, true
+	}
+}
+
+// stopUpdate returns the update of a trip for one of its stop times.
+func (trip *realtimeTrip) stopUpdate(st *StopTime) *realtimeStop {
+	for i := range trip.stops {
+		update := &trip.stops[i]
+		if update.stopSequence >= 0 && update.stopSequence == st.StopSequence ||
+			update.stopSequence < 0 && update.stopId == st.StopId {
+			return update
+		}
+	}
+	return nil
+}
+
+// setDelays predicts a placed stop time's arrival and departure from
+// their delays.
+func (st *StopTime) setDelays(arrival int, departure int) {
+	st.ScheduleRelationship = "SCHEDULED"
+	if st.ArrivesAt != nil {
+		predicted := st.ArrivesAt.Add(time.Duration(arrival) * time.Second)
+		st.PredictedArrival = &predicted
+	}
+	if st.DepartsAt != nil {
+		predicted := st.DepartsAt.Add(time.Duration(departure) * time.Second)
+		st.PredictedDeparture = &predicted
+	}
+
+	delay := departure
+	if st.DepartsAt == nil {
+		delay = arrival
+	}
+	st.Delay = &delay
+}
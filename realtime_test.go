@@ -0,0 +1,220 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testFeedMessage is a differential FeedMessage with a TripUpdate of
+// the run of T1 on 2026-03-02, a deleted trip T2, a cancelled trip T3
+// and an alert that is not read.
+func testFeedMessage() []byte {
+	header := protoBytesField(nil, 1, []byte("2.0"))
+	header = protoVarintField(header, 2, rtDifferential)
+	header = protoVarintField(header, 3, 1772442000)
+
+	descriptor := protoBytesField(nil, 1, []byte("T1"))
+	descriptor = protoBytesField(descriptor, 2, []byte("R1"))
+	descriptor = protoBytesField(descriptor, 3, []byte("20260302"))
+
+	// Stop 2 arrives 2 minutes late; stop C, by ID, departs at an
+	// instant; stop 4 is skipped.
+	late := protoBytesField(nil, 2, protoVarintField(nil, 1, 120))
+	late = protoVarintField(late, 1, 2)
+	byId := protoBytesField(nil, 4, []byte("C"))
+	byId = protoBytesField(byId, 3, protoVarintField(nil, 2, 1772445600))
+	skipped := protoVarintField(nil, 1, 4)
+	skipped = protoVarintField(skipped, 5, rtStopSkipped)
+
+	update := protoBytesField(nil, 1, descriptor)
+	update = protoBytesField(update, 2, late)
+	update = protoBytesField(update, 2, byId)
+	update = protoBytesField(update, 2, skipped)
+	delay := -30
+	update = protoVarintField(update, 5, uint64(delay))
+
+	entity := protoBytesField(nil, 1, []byte("e1"))
+	entity = protoBytesField(entity, 3, update)
+
+	deleted := protoBytesField(nil, 1, []byte("e2"))
+	deleted = protoVarintField(deleted, 2, 1)
+	deleted = protoBytesField(deleted, 3, protoBytesField(nil, 1, protoBytesField(nil, 1, []byte("T2"))))
+
+	canceled := protoBytesField(nil, 1, []byte("e3"))
+	canceled = protoBytesField(canceled, 3, protoBytesField(nil, 1, protoVarintField(protoBytesField(nil, 1, []byte("T3")), 4, rtTripCanceled)))
+
+	alert := protoBytesField(nil, 1, []byte("e4"))
+	alert = protoBytesField(alert, 5, protoBytesField(nil, 1, nil))
+
+	message := protoBytesField(nil, 1, header)
+	for _, e := range [][]byte{entity, deleted, canceled, alert} {
+		message = protoBytesField(message, 2, e)
+	}
+	return message
+}
+
+func TestDecodeTripUpdates(t *testing.T) {
+	message, err := decodeTripUpdates(testFeedMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !message.differential {
+		t.Error("message is not differential")
+	}
+	if want := time.Unix(1772442000, 0); !message.timestamp.Equal(want) {
+		t.Errorf("timestamp = %v, want %v", message.timestamp, want)
+	}
+	if !reflect.DeepEqual(message.deleted, []string{"T2"}) {
+		t.Errorf("deleted = %v, want [T2]", message.deleted)
+	}
+
+	want := []realtimeTrip{
+		{
+			tripId:    "T1",
+			startDate: "20260302",
+			delay:     -30,
+			hasDelay:  true,
+			stops: []realtimeStop{
+				{stopSequence: 2, arrival: realtimeEvent{delay: 120, hasDelay: true}},
+				{stopSequence: -1, stopId: "C", departure: realtimeEvent{time: 1772445600}},
+				{stopSequence: 4, relationship: rtStopSkipped},
+			},
+		},
+		{tripId: "T3", canceled: true},
+	}
+	if !reflect.DeepEqual(message.trips, want) {
+		t.Errorf("trips = %+v, want %+v", message.trips, want)
+	}
+
+	data := testFeedMessage()
+	if _, err := decodeTripUpdates(data[:len(data)-1]); err == nil {
+		t.Error("truncated message decoded")
+	}
+}
+
+func TestPredict(t *testing.T) {
+	start := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	const none = -1 << 31
+
+	tests := []struct {
+		name          string
+		trip          realtimeTrip
+		relationships []string
+		delays        []int
+	}{
+		{
+			"delay carried forward",
+			realtimeTrip{stops: []realtimeStop{
+				{stopSequence: 2, arrival: realtimeEvent{delay: 120, hasDelay: true}},
+			}},
+			[]string{"", "SCHEDULED", "SCHEDULED", "SCHEDULED", "SCHEDULED"},
+			[]int{none, 120, 120, 120, 120},
+		},
+		{
+			"trip delay",
+			realtimeTrip{delay: 60, hasDelay: true, stops: []realtimeStop{
+				{stopSequence: 4, departure: realtimeEvent{delay: -30, hasDelay: true}},
+			}},
+			[]string{"SCHEDULED", "SCHEDULED", "SCHEDULED", "SCHEDULED", "SCHEDULED"},
+			[]int{60, 60, 60, -30, -30},
+		},
+		{
+			"skipped stop",
+			realtimeTrip{stops: []realtimeStop{
+				{stopSequence: 2, arrival: realtimeEvent{delay: 120, hasDelay: true}},
+				{stopSequence: 3, relationship: rtStopSkipped},
+			}},
+			[]string{"", "SCHEDULED", "SKIPPED", "SCHEDULED", "SCHEDULED"},
+			[]int{none, 120, none, 120, 120},
+		},
+		{
+			"no data",
+			realtimeTrip{stops: []realtimeStop{
+				{stopSequence: 2, arrival: realtimeEvent{delay: 120, hasDelay: true}},
+				{stopSequence: 3, relationship: rtStopNoData},
+				{stopSequence: 5, arrival: realtimeEvent{delay: 0, hasDelay: true}},
+			}},
+			[]string{"", "SCHEDULED", "NO_DATA", "", "SCHEDULED"},
+			[]int{none, 120, none, none, 0},
+		},
+		{
+			"by stop ID and instant",
+			realtimeTrip{stops: []realtimeStop{
+				{stopSequence: -1, stopId: "C", departure: realtimeEvent{time: start.Unix() + 3*3600 + 30 + 90}},
+			}},
+			[]string{"", "", "SCHEDULED", "SCHEDULED", "SCHEDULED"},
+			[]int{none, none, 90, 90, 90},
+		},
+		{
+			"cancelled trip",
+			realtimeTrip{canceled: true, delay: 60, hasDelay: true},
+			[]string{"CANCELED", "CANCELED", "CANCELED", "CANCELED", "CANCELED"},
+			[]int{none, none, none, none, none},
+		},
+	}
+	for _, test := range tests {
+		rows := []StopTime{}
+		for i, stopId := range []string{"A", "B", "C", "D", "E"} {
+			st := StopTime{
+				TripId:        "T1",
+				StopId:        stopId,
+				StopSequence:  i + 1,
+				ArrivalTime:   GtfsTime(3600 * (i + 1)),
+				DepartureTime: GtfsTime(3600*(i+1) + 30),
+			}
+			st.placeOn(start)
+			rows = append(rows, st)
+		}
+
+		test.trip.predict(rows)
+		for i, st := range rows {
+			delay := none
+			if st.Delay != nil {
+				delay = *st.Delay
+			}
+			if st.ScheduleRelationship != test.relationships[i] || delay != test.delays[i] {
+				t.Errorf("%s: stop %d is %q with delay %d, want %q with %d", test.name, i+1, st.ScheduleRelationship, delay, test.relationships[i], test.delays[i])
+			}
+			if st.Delay != nil && st.PredictedDeparture.Sub(*st.DepartsAt) != time.Duration(*st.Delay)*time.Second {
+				t.Errorf("%s: stop %d departs %v, delay %d", test.name, i+1, st.PredictedDeparture, *st.Delay)
+			}
+		}
+	}
+}
+
+func TestIngestRealtimeFromSource(t *testing.T) {
+	current, stale := &realtimeSource{source: "current"}, &realtimeSource{source: "stale"}
+	realtimeMutex.Lock()
+	realtimeSources["test"] = current
+	realtimeMutex.Unlock()
+	defer func() {
+		realtimeMutex.Lock()
+		delete(realtimeSources, "test")
+		delete(realtimeFeeds, "test")
+		realtimeMutex.Unlock()
+	}()
+
+	tests := []struct {
+		name   string
+		from   *realtimeSource
+		stored bool
+	}{
+		{"from a source no longer polled", stale, false},
+		{"from the source polled", current, true},
+		{"pushed", nil, true},
+	}
+	for _, test := range tests {
+		realtimeMutex.Lock()
+		delete(realtimeFeeds, "test")
+		realtimeMutex.Unlock()
+
+		if err := ingestRealtime("test", testFeedMessage(), test.from); err != nil {
+			t.Fatal(err)
+		}
+		if stored := realtimeFor("test") != nil; stored != test.stored {
+			t.Errorf("%s: stored %v, want %v", test.name, stored, test.stored)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCachedServiceDays bounds the service cache; it is emptied when full.
+const maxCachedServiceDays = 1000
+
+// textArray binds a list of strings as a single PostgreSQL text[]
+// parameter, so values are never spliced into the SQL.
+type textArray []string
+
+func (a textArray) Value() (driver.Value, error) {
+	quoted := make([]string, len(a))
+	for i, value := range a {
+		value = strings.Replace(value, `\`, `\\`, -1)
+		value = strings.Replace(value, `"`, `\"`, -1)
+		quoted[i] = `"` + value + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}", nil
+}
+
+// activeServiceSQL is the set of (feedid, serviceid) pairs bound by a
+// serviceSet, for use as "(feedid, serviceid) in " + activeServiceSQL.
+// An empty set matches nothing.
+const activeServiceSQL = "(select * from unnest(cast(:serviceFeeds as text[]), cast(:serviceIds as text[])))"
+
+// serviceSet is the services running on a day, ready to bind to a query
+// using activeServiceSQL.
+type serviceSet struct {
+	feedIds    textArray
+	serviceIds textArray
+}
+
+func newServiceSet(calendars []Calendar) serviceSet {
+	set := serviceSet{feedIds: textArray{}, serviceIds: textArray{}}
+	for _, calendar := range calendars {
+		set.feedIds = append(set.feedIds, calendar.FeedId)
+		set.serviceIds = append(set.serviceIds, calendar.ServiceId)
+	}
+	return set
+}
+
+func (set serviceSet) empty() bool {
+	return len(set.serviceIds) == 0
+}
+
+// bind adds the parameters of activeServiceSQL to the parameters of a
+// query.
+func (set serviceSet) bind(params map[string]interface{}) map[string]interface{} {
+	params["serviceFeeds"] = set.feedIds
+	params["serviceIds"] = set.serviceIds
+	return params
+}
+
+// serviceCache remembers the calendars running on each day of each feed
+// until the feed is reloaded.
+var serviceCache = struct {
+	sync.Mutex
+	byDay map[string][]Calendar
+}{byDay: map[string][]Calendar{}}
+
+// servicesOn returns the calendars of a feed running on the date of
+// local, read in the feed's timezone.
+func servicesOn(feedId string, local time.Time) ([]Calendar, error) {
+	date := local.Format("2006-01-02")
+	key := feedId + "\x00" + date
+
+	serviceCache.Lock()
+	services, ok := serviceCache.byDay[key]
+	serviceCache.Unlock()
+	if ok {
+		return services, nil
+	}
+
+	generation := feedGeneration(feedId)
+	params := map[string]interface{}{
+		"date": date,
+		"feed": feedId,
+	}
+
+	calendars := []Calendar{}
+	_, err := dbMap.Select(&calendars, "select * from calendar where feedid = :feed "+
+		"and (startdate <= :date and enddate >= :date "+
+		"or serviceid in (select serviceid from calendardate where feedid = :feed and date = :date and exceptiontype = 1))", params)
+	if err != nil {
+		return nil, fmt.Errorf("finding service for %s on %s: %v", feedId, date, err)
+	}
+	exceptions := []CalendarDate{}
+	_, err = dbMap.Select(&exceptions, "select * from calendardate where feedid = :feed and date = :date", params)
+	if err != nil {
+		return nil, fmt.Errorf("finding service for %s on %s: %v", feedId, date, err)
+	}
+
+	services = runningServices(feedId, local, calendars, exceptions)
+	log.Println("Feed", feedId, "runs", len(services), "services on", local.Weekday(), date)
+
+	serviceCache.Lock()
+	if len(serviceCache.byDay) >= maxCachedServiceDays {
+		serviceCache.byDay = map[string][]Calendar{}
+	}
+	if feedGeneration(feedId) == generation {
+		serviceCache.byDay[key] = services
+	}
+	serviceCache.Unlock()
+
+	return services, nil
+}
+
+// runningServices picks the services running on the date of local from
+// the calendars that may cover it and the exceptions of that date. A
+// service added on the date by calendar_dates.txt alone is given a
+// calendar of just that date, running on no day of the week.
+func runningServices(feedId string, local time.Time, calendars []Calendar, exceptions []CalendarDate) []Calendar {
+	date := local.Format("20060102")
+
+	added, removed := map[string]bool{}, map[string]bool{}
+	for _, exception := range exceptions {
+		switch exception.ExceptionType {
+		case 1:
+			added[exception.ServiceId] = true
+		case 2:
+			removed[exception.ServiceId] = true
+		}
+	}
+
+	running := []Calendar{}
+	for _, calendar := range calendars {
+		weekdays := []string{calendar.Sunday, calendar.Monday, calendar.Tuesday, calendar.Wednesday, calendar.Thursday, calendar.Friday, calendar.Saturday}
+		scheduled := calendar.StartDate.Format("20060102") <= date && calendar.EndDate.Format("20060102") >= date &&
+			weekdays[local.Weekday()] == "1"
+		if added[calendar.ServiceId] || scheduled && !removed[calendar.ServiceId] {
+			running = append(running, calendar)
+			delete(added, calendar.ServiceId)
+		}
+	}
+
+	day := newGtfsDate(date)
+	for _, exception := range exceptions {
+		if added[exception.ServiceId] {
+			running = append(running, Calendar{
+				FeedId:    feedId,
+				ServiceId: exception.ServiceId,
+				Monday:    "0",
+				Tuesday:   "0",
+				Wednesday: "0",
+				Thursday:  "0",
+				Friday:    "0",
+				Saturday:  "0",
+				Sunday:    "0",
+				StartDate: day,
+				EndDate:   day,
+			})
+			delete(added, exception.ServiceId)
+		}
+	}
+	return running
+}
+
+// forgetServices empties the cached services of a feed.
+func forgetServices(feedId string) {
+	serviceCache.Lock()
+	defer serviceCache.Unlock()
+
+	for key := range serviceCache.byDay {
+		if strings.HasPrefix(key, feedId+"\x00") {
+			delete(serviceCache.byDay, key)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunningServices(t *testing.T) {
+	// A Monday.
+	monday := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	weekdays := Calendar{FeedId: "f", ServiceId: "weekdays", Monday: "1", Tuesday: "1", Wednesday: "1", Thursday: "1", Friday: "1", Saturday: "0", Sunday: "0",
+		StartDate: newGtfsDate("20260101"), EndDate: newGtfsDate("20261231")}
+	weekends := Calendar{FeedId: "f", ServiceId: "weekends", Monday: "0", Tuesday: "0", Wednesday: "0", Thursday: "0", Friday: "0", Saturday: "1", Sunday: "1",
+		StartDate: newGtfsDate("20260101"), EndDate: newGtfsDate("20261231")}
+	ended := weekdays
+	ended.ServiceId, ended.EndDate = "ended", newGtfsDate("20260301")
+
+	exception := func(serviceId string, exceptionType int) CalendarDate {
+		return CalendarDate{FeedId: "f", ServiceId: serviceId, Date: newGtfsDate("20260302"), ExceptionType: exceptionType}
+	}
+
+	tests := []struct {
+		name       string
+		calendars  []Calendar
+		exceptions []CalendarDate
+		want       []string
+	}{
+		{"calendar only", []Calendar{weekdays, weekends, ended}, nil, []string{"weekdays"}},
+		{"removed", []Calendar{weekdays}, []CalendarDate{exception("weekdays", 2)}, []string{}},
+		{"added to a calendar", []Calendar{weekdays, weekends}, []CalendarDate{exception("weekends", 1)}, []string{"weekdays", "weekends"}},
+		{"calendar_dates only", nil, []CalendarDate{exception("holiday", 1), exception("strike", 2), exception("extra", 1)}, []string{"holiday", "extra"}},
+	}
+	for _, test := range tests {
+		running := runningServices("f", monday, test.calendars, test.exceptions)
+
+		serviceIds := []string{}
+		for _, calendar := range running {
+			serviceIds = append(serviceIds, calendar.ServiceId)
+		}
+		if !reflect.DeepEqual(serviceIds, test.want) {
+			t.Errorf("%s: running %v, want %v", test.name, serviceIds, test.want)
+		}
+	}
+
+	running := runningServices("f", monday, nil, []CalendarDate{exception("holiday", 1)})
+	if len(running) != 1 || running[0].FeedId != "f" || running[0].Monday != "0" ||
+		running[0].StartDate.Format("20060102") != "20260302" || running[0].EndDate.Format("20060102") != "20260302" {
+		t.Errorf("calendar for a calendar_dates service = %+v, want one of just 2026-03-02", running)
+	}
+	if set := newServiceSet(running); set.empty() || set.serviceIds[0] != "holiday" {
+		t.Errorf("service set = %+v, want the holiday service", set)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/paulmach/go.geo"
+	"github.com/paulmach/go.geo/reducers"
+	"github.com/paulmach/go.geojson"
+)
+
+// defaultShapeTolerance is how far in degrees, about a metre, simplified
+// shapes may stray from their points unless a request says otherwise.
+const defaultShapeTolerance = 1.0e-5
+
+// shapeReducer simplifies the path of a shape.
+type shapeReducer func(path *geo.Path) *geo.Path
+
+// defaultShapeReducer is the Douglas-Peucker simplification shapes are
+// served with by default.
+func defaultShapeReducer(path *geo.Path) *geo.Path {
+	return reducers.DouglasPeucker(path, defaultShapeTolerance)
+}
+
+// parseReducer reads the reducer and tolerance parameters of the shape
+// endpoints. The tolerance of "douglas-peucker" and "radial" is a
+// distance in degrees; that of "visvalingam" is a triangle area in
+// square degrees. "none" keeps every point.
+func parseReducer(reducer string, tolerance string) (shapeReducer, error) {
+	threshold := defaultShapeTolerance
+	if reducer == "visvalingam" {
+		threshold = defaultShapeTolerance * defaultShapeTolerance
+	}
+	if tolerance != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(tolerance, 64)
+		if err != nil || threshold < 0 {
+			return nil, fmt.Errorf("invalid tolerance %q", tolerance)
+		}
+	}
+
+	switch reducer {
+	case "", "dp", "douglas-peucker":
+		return func(path *geo.Path) *geo.Path {
+			return reducers.DouglasPeucker(path, threshold)
+		}, nil
+	case "visvalingam":
+		return func(path *geo.Path) *geo.Path {
+			return reducers.Visvalingam(path, threshold, 2)
+		}, nil
+	case "radial":
+		return func(path *geo.Path) *geo.Path {
+			return reducers.Radial(path, threshold)
+		}, nil
+	case "none":
+		return func(path *geo.Path) *geo.Path {
+			return path
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid reducer %q, expected none, douglas-peucker, visvalingam or radial", reducer)
+}
+
+// shapeEncodings are the ways a shape's path can be written in JSON.
+var shapeEncodings = map[string]bool{
+	"polyline":  true,
+	"polyline5": true,
+	"polyline6": true,
+	"geojson":   true,
+	"wkb":       true,
+	"coords":    true,
+}
+
+// shapeOptions are how the shapes of a response are simplified and
+// written.
+type shapeOptions struct {
+	geoJSON  bool
+	reduce   shapeReducer
+	encoding string
+}
+
+// parseShapeOptions reads the format, reducer, tolerance and encoding
+// parameters of the shape endpoints.
+func (serv TransitService) parseShapeOptions(format string, reducer string, tolerance string, encoding string) (shapeOptions, error) {
+	options := shapeOptions{encoding: encoding}
+
+	var err error
+	if options.geoJSON, err = serv.wantsGeoJSON(format); err != nil {
+		return options, err
+	}
+	if options.reduce, err = parseReducer(reducer, tolerance); err != nil {
+		return options, err
+	}
+
+	if options.encoding == "" {
+		options.encoding = "polyline"
+	}
+	if !shapeEncodings[options.encoding] {
+		return options, fmt.Errorf("invalid encoding %q, expected polyline5, polyline6, geojson, wkb or coords", encoding)
+	}
+	return options, nil
+}
+
+// shapeResponse simplifies shapes and writes them as the options ask,
+// either returning them or responding with GeoJSON.
+func (serv TransitService) shapeResponse(shapes []Shape, options shapeOptions) []ShapePath {
+	all := []ShapePath{}
+
+	lines := shapeLines(shapes, options.reduce)
+	if options.geoJSON {
+		serv.writeGeoJSON(shapeFeatures(lines))
+		return all
+	}
+
+	for _, line := range lines {
+		all = append(all, encodeShape(line, options.encoding))
+	}
+	return all
+}
+
+// encodeShape writes the path of a shape in one of shapeEncodings.
+func encodeShape(line shapeLine, encoding string) ShapePath {
+	shape := ShapePath{
+		FeedId:  line.FeedId,
+		ShapeId: line.ShapeId,
+	}
+
+	switch encoding {
+	case "polyline", "polyline5":
+		shape.Path = line.path.Encode()
+	case "polyline6":
+		shape.Path = line.path.Encode(1.0e6)
+	case "geojson":
+		shape.Geometry = line.path.ToGeoJSON().Geometry
+	case "wkb":
+		shape.Path = hex.EncodeToString(lineStringWKB(line.path))
+	case "coords":
+		shape.Coordinates = line.path.ToGeoJSON().Geometry.LineString
+	}
+	return shape
+}
+
+// lineStringWKB returns a path as a little-endian well-known binary
+// LineString.
+func lineStringWKB(path *geo.Path) []byte {
+	var wkb bytes.Buffer
+	wkb.WriteByte(1)
+	binary.Write(&wkb, binary.LittleEndian, uint32(2))
+	binary.Write(&wkb, binary.LittleEndian, uint32(path.Length()))
+	for _, p := range path.PointSet {
+		binary.Write(&wkb, binary.LittleEndian, [2]float64{p.Lng(), p.Lat()})
+	}
+	return wkb.Bytes()
+}
+
+// shapeLine is the path of one shape, simplified for display.
+type shapeLine struct {
+	FeedId  string
+	ShapeId string
+	path    *geo.Path
+}
+
+// shapeLines joins shape points, ordered by feed, shape and sequence,
+// into one path per shape, simplified by reduce.
+func shapeLines(shapes []Shape, reduce shapeReducer) []shapeLine {
+	lines := []shapeLine{}
+
+	var currentFeed, currentShape string
+	points := [][2]float64{}
+
+	flush := func() {
+		if len(points) > 0 {
+			path := geo.NewPathFromXYData(points)
+			lines = append(lines, shapeLine{
+				FeedId:  currentFeed,
+				ShapeId: currentShape,
+				path:    reduce(path),
+			})
+		}
+	}
+
+	for _, shape := range shapes {
+		if currentShape != shape.ShapeId || currentFeed != shape.FeedId {
+			flush()
+			points = [][2]float64{}
+			currentFeed = shape.FeedId
+			currentShape = shape.ShapeId
+		}
+		points = append(points, [2]float64{shape.ShapePtLon, shape.ShapePtLat})
+	}
+	flush()
+
+	return lines
+}
+
+// RouteShapes is a route with the shapes its trips follow.
+type RouteShapes struct {
+	Route
+	Shapes []ShapePath `json:"shapes"`
+}
+
+// routeShape links a route to a shape one of its trips follows.
+type routeShape struct {
+	FeedId  string
+	RouteId string
+	ShapeId string
+}
+
+// networkTrips selects the trips running on the bound services, of
+// routes of :routeType when it is set.
+const networkTrips = "select t.feedid, t.routeid, t.shapeid from trip t " +
+	"join route r on r.feedid = t.feedid and r.routeid = t.routeid " +
+	"where (:routeType = '' or r.routetype = :routeType) and t.shapeid <> '' " +
+	"and (t.feedid, t.serviceid) in " + activeServiceSQL
+
+// Network returns every route running on a day, optionally only those
+// of one route type, with the shapes of its trips.
+func (serv TransitService) Network(routeType string, feed string, date string, format string) []RouteShapes {
+	all := []RouteShapes{}
+
+	geoJSON, err := serv.wantsGeoJSON(format)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+	day, err := parseServiceDate(date)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+
+	services, err := serv.activeServices(feed, day)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+	params := func() map[string]interface{} {
+		return services.bind(map[string]interface{}{
+			"routeType": routeType,
+		})
+	}
+
+	routes := []Route{}
+	_, err = dbMap.Select(&routes, "select * from route where (:routeType = '' or routetype = :routeType) "+
+		"and (feedid, routeid) in (select distinct feedid, routeid from trip where (feedid, serviceid) in "+activeServiceSQL+") "+
+		"order by feedid, routeshortname, routeid", params())
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+
+	links := []routeShape{}
+	_, err = dbMap.Select(&links, "select distinct * from ("+networkTrips+") trips order by feedid, routeid, shapeid", params())
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+
+	shapes := []Shape{}
+	_, err = dbMap.Select(&shapes, "select * from shape where (feedid, shapeid) in (select feedid, shapeid from ("+networkTrips+") trips) "+
+		"order by feedid, shapeid, shapeptsequence", params())
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+
+	lines := map[[2]string]shapeLine{}
+	for _, line := range shapeLines(shapes, defaultShapeReducer) {
+		lines[[2]string{line.FeedId, line.ShapeId}] = line
+	}
+	shapesOf := map[[2]string][]shapeLine{}
+	for _, link := range links {
+		if line, ok := lines[[2]string{link.FeedId, link.ShapeId}]; ok {
+			key := [2]string{link.FeedId, link.RouteId}
+			shapesOf[key] = append(shapesOf[key], line)
+		}
+	}
+
+	if geoJSON {
+		serv.writeGeoJSON(networkFeatures(routes, shapesOf))
+		return all
+	}
+
+	for _, route := range routes {
+		paths := []ShapePath{}
+		for _, line := range shapesOf[[2]string{route.FeedId, route.RouteId}] {
+			paths = append(paths, encodeShape(line, "polyline"))
+		}
+		all = append(all, RouteShapes{Route: route, Shapes: paths})
+	}
+
+	return all
+}
+
+// networkFeatures returns a multi-line feature for each route with
+// shapes, carrying the route's fields and the IDs of its shapes.
+func networkFeatures(routes []Route, shapesOf map[[2]string][]shapeLine) *geojson.FeatureCollection {
+	collection := geojson.NewFeatureCollection()
+	for _, route := range routes {
+		lines := shapesOf[[2]string{route.FeedId, route.RouteId}]
+		if len(lines) == 0 {
+			continue
+		}
+
+		coordinates := [][][]float64{}
+		shapeIds := []string{}
+		for _, line := range lines {
+			coordinates = append(coordinates, line.path.ToGeoJSON().Geometry.LineString)
+			shapeIds = append(shapeIds, line.ShapeId)
+		}
+
+		feature := geojson.NewMultiLineStringFeature(coordinates...)
+		feature.Properties = featureProperties(route)
+		feature.SetProperty("shape_ids", shapeIds)
+		collection.AddFeature(feature)
+	}
+	return collection
+}
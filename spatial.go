@@ -0,0 +1,230 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulmach/go.geo"
+)
+
+// stopCellBits is the precision of the geohash cells stops are bucketed
+// in: 15 bits each of longitude and latitude, cells of roughly
+// 1.2 x 0.6 km at the equator.
+const stopCellBits = 30
+
+var (
+	stopCellWidth  = 360 / math.Exp2(stopCellBits/2)
+	stopCellHeight = 180 / math.Exp2(stopCellBits/2)
+)
+
+// stopIndex is an in-memory geohash grid over the stops of one feed,
+// answering range and nearest-stop queries without touching the
+// database.
+type stopIndex struct {
+	stops []Stop
+	cells map[int64][]int
+}
+
+// nearStop is a stop found near a point, with its distance in meters.
+type nearStop struct {
+	Stop
+	distance float64
+}
+
+func newStopIndex(stops []Stop) *stopIndex {
+	index := &stopIndex{stops: stops, cells: map[int64][]int{}}
+	for i := range stops {
+		cell := stopPoint(&stops[i]).GeoHashInt64(stopCellBits)
+		index.cells[cell] = append(index.cells[cell], i)
+	}
+	return index
+}
+
+// stopPoint returns the location of a stop as a lng/lat point.
+func stopPoint(stop *Stop) *geo.Point {
+	return geo.NewPoint(stop.StopLon, stop.StopLat)
+}
+
+// within returns the stops no further than radius meters from center.
+func (index *stopIndex) within(center *geo.Point, radius float64, keep func(*Stop) bool) []nearStop {
+	found := []nearStop{}
+
+	bound := geo.NewGeoBoundAroundPoint(center, radius)
+	west, east := bound.SouthWest().Lng(), bound.NorthEast().Lng()
+	if west > east {
+		// The bound crosses the antimeridian.
+		west, east = -180, 180
+	}
+	south, north := bound.SouthWest().Lat(), bound.NorthEast().Lat()
+
+	add := func(stop *Stop) {
+		if keep != nil && !keep(stop) {
+			return
+		}
+		if distance := stopPoint(stop).GeoDistanceFrom(center, true); distance <= radius {
+			found = append(found, nearStop{*stop, distance})
+		}
+	}
+
+	// A bound wider than the grid is cheaper to answer stop by stop.
+	if ((east-west)/stopCellWidth+1)*((north-south)/stopCellHeight+1) > float64(len(index.cells)) {
+		for i := range index.stops {
+			add(&index.stops[i])
+		}
+		return found
+	}
+
+	// Visit the centre of every cell overlapping the bound.
+	for lat := cellCentre(south, -90, stopCellHeight); lat < north+stopCellHeight/2; lat += stopCellHeight {
+		for lng := cellCentre(west, -180, stopCellWidth); lng < east+stopCellWidth/2; lng += stopCellWidth {
+			cell := geo.NewPoint(lng, lat).GeoHashInt64(stopCellBits)
+			for _, i := range index.cells[cell] {
+				add(&index.stops[i])
+			}
+		}
+	}
+
+	return found
+}
+
+// cellCentre returns the centre of the cell holding value, for cells of
+// the given size starting at origin.
+func cellCentre(value float64, origin float64, size float64) float64 {
+	return origin + (math.Floor((value-origin)/size)+0.5)*size
+}
+
+// nearest returns up to k stops closest to center, no further than
+// maxDistance meters, nearest first. It searches ever wider circles
+// until one holds k stops.
+func (index *stopIndex) nearest(center *geo.Point, k int, maxDistance float64, keep func(*Stop) bool) []nearStop {
+	total := countStops(index, keep)
+
+	found := []nearStop{}
+	for radius := stopCellHeight * 111000; ; radius *= 2 {
+		if radius > maxDistance {
+			radius = maxDistance
+		}
+
+		found = index.within(center, radius, keep)
+		if len(found) >= k || len(found) == total || radius >= maxDistance {
+			break
+		}
+	}
+
+	sortNearStops(found)
+	if len(found) > k {
+		found = found[:k]
+	}
+	return found
+}
+
+// countStops counts the stops a search could ever return.
+func countStops(index *stopIndex, keep func(*Stop) bool) int {
+	if keep == nil {
+		return len(index.stops)
+	}
+	n := 0
+	for i := range index.stops {
+		if keep(&index.stops[i]) {
+			n++
+		}
+	}
+	return n
+}
+
+func sortNearStops(stops []nearStop) {
+	sort.SliceStable(stops, func(i, j int) bool {
+		return stops[i].distance < stops[j].distance
+	})
+}
+
+var (
+	stopIndexesMutex sync.Mutex
+	// stopIndexes holds the index of each feed until it is reloaded.
+	stopIndexes = map[string]*stopIndex{}
+)
+
+// stopIndexFor returns the index of a feed's stops, building it on first
+// use.
+func stopIndexFor(feedId string) (*stopIndex, error) {
+	stopIndexesMutex.Lock()
+	index, ok := stopIndexes[feedId]
+	stopIndexesMutex.Unlock()
+	if ok {
+		return index, nil
+	}
+
+	generation := feedGeneration(feedId)
+	started := time.Now()
+	stops := []Stop{}
+	_, err := dbMap.Select(&stops, "select * from stop where feedid = :feed", map[string]interface{}{
+		"feed": feedId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	index = newStopIndex(stops)
+	log.Printf("Indexed %d stops of feed %s in %v", len(stops), feedId, time.Since(started))
+
+	stopIndexesMutex.Lock()
+	if feedGeneration(feedId) == generation {
+		stopIndexes[feedId] = index
+	}
+	stopIndexesMutex.Unlock()
+	return index, nil
+}
+
+// forgetStopIndex drops the index of a feed.
+func forgetStopIndex(feedId string) {
+	stopIndexesMutex.Lock()
+	delete(stopIndexes, feedId)
+	stopIndexesMutex.Unlock()
+}
+
+// stopsWithin returns the stops of every feed the query covers within
+// radius meters of center, nearest first.
+func stopsWithin(feed string, center *geo.Point, radius float64) ([]nearStop, error) {
+	feedIds, err := feedIdsFor(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []nearStop{}
+	for _, feedId := range feedIds {
+		index, err := stopIndexFor(feedId)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, index.within(center, radius, nil)...)
+	}
+
+	sortNearStops(found)
+	return found, nil
+}
+
+// nearestStops returns the k stops of the feeds the query covers nearest
+// to center, no further than maxDistance meters, that keep accepts.
+func nearestStops(feed string, center *geo.Point, k int, maxDistance float64, keep func(*Stop) bool) ([]nearStop, error) {
+	feedIds, err := feedIdsFor(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	found := []nearStop{}
+	for _, feedId := range feedIds {
+		index, err := stopIndexFor(feedId)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, index.nearest(center, k, maxDistance, keep)...)
+	}
+
+	sortNearStops(found)
+	if len(found) > k {
+		found = found[:k]
+	}
+	return found, nil
+}
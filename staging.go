@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// staleStagingAge is how old a staging schema must be before it is taken
+// for the leftover of an interrupted load. Younger ones may belong to a
+// load another server on the same database is running.
+const staleStagingAge = 24 * time.Hour
+
+// requiredTables must all have rows before a feed can go live.
+var requiredTables = []string{"agency", "stop", "route", "trip", "stoptime"}
+
+// stagingArea is a private schema a feed is imported into. Readers keep
+// using the live tables until the staged rows are promoted in a single
+// transaction, so they never see a partially loaded feed.
+type stagingArea struct {
+	schema string
+}
+
+// newStagingArea creates an empty copy of every feed table in a schema of
+// its own, so concurrent loads never share staging tables.
+func newStagingArea() (*stagingArea, error) {
+	staging := &stagingArea{schema: fmt.Sprintf("staging_%d", time.Now().UnixNano())}
+
+	if _, err := dbMap.Exec("create schema " + staging.schema); err != nil {
+		return nil, err
+	}
+
+	for _, table := range feedTables {
+		name := strings.ToLower(table.name)
+		_, err := dbMap.Exec(fmt.Sprintf("create table %s (like public.%s including defaults)", staging.table(name), name))
+		if err != nil {
+			staging.drop()
+			return nil, err
+		}
+	}
+
+	return staging, nil
+}
+
+// table returns the qualified name of a staged table.
+func (staging *stagingArea) table(name string) string {
+	return staging.schema + "." + strings.ToLower(name)
+}
+
+// index builds the indexes the validation and promotion queries rely on.
+func (staging *stagingArea) index() error {
+	log.Println("Indexing", staging.schema)
+
+	indexes := []string{
+		"create index on %s (tripid)",
+		"create index on %s (stopid)",
+	}
+	for _, index := range indexes {
+		if _, err := dbMap.Exec(fmt.Sprintf(index, staging.table("stoptime"))); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range []string{"trip", "stop", "route", "calendar", "shape"} {
+		if _, err := dbMap.Exec("analyze " + staging.table(table)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate refuses feeds that are missing any of the core files.
+func (staging *stagingArea) validate() error {
+	for _, table := range requiredTables {
+		count, err := dbMap.SelectInt("select count(*) from " + staging.table(table))
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("feed has no %s rows", table)
+		}
+	}
+
+	services, err := dbMap.SelectInt("select (select count(*) from " + staging.table("calendar") +
+		") + (select count(*) from " + staging.table("calendardate") + ")")
+	if err != nil {
+		return err
+	}
+	if services == 0 {
+		return fmt.Errorf("feed has neither calendar nor calendar_dates rows")
+	}
+
+	return nil
+}
+
+// promote replaces the live rows of a feed with the staged ones in one
+// transaction.
+func (staging *stagingArea) promote(feedId string, source string) error {
+	log.Println("Promoting", staging.schema, "to feed", feedId)
+
+	transaction, err := dbMap.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range feedTables {
+		name := strings.ToLower(table.name)
+
+		if _, err := transaction.Exec("delete from "+name+" where feedid = $1", feedId); err != nil {
+			transaction.Rollback()
+			return err
+		}
+		if _, err := transaction.Exec("insert into " + name + " select * from " + staging.table(name)); err != nil {
+			transaction.Rollback()
+			return err
+		}
+	}
+
+	if _, err := transaction.Exec("delete from feed where feedid = $1", feedId); err != nil {
+		transaction.Rollback()
+		return err
+	}
+
+	err = transaction.Insert(&Feed{
+		FeedId:   feedId,
+		Source:   source,
+		LoadedAt: time.Now(),
+	})
+	if err != nil {
+		transaction.Rollback()
+		return err
+	}
+
+	return transaction.Commit()
+}
+
+// drop discards the staging schema and everything in it.
+func (staging *stagingArea) drop() {
+	if _, err := dbMap.Exec("drop schema if exists " + staging.schema + " cascade"); err != nil {
+		log.Println("Dropping", staging.schema, "failed.", err)
+	}
+}
+
+// dropStaleStaging removes staging schemas left behind by loads that were
+// interrupted, telling them by the time their names were made at.
+func dropStaleStaging() {
+	schemas := []string{}
+	_, err := dbMap.Select(&schemas, "select nspname from pg_namespace where nspname like 'staging\\_%'")
+	if err != nil {
+		log.Println("Listing staging schemas failed.", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-staleStagingAge).UnixNano()
+	for _, schema := range schemas {
+		created, err := strconv.ParseInt(strings.TrimPrefix(schema, "staging_"), 10, 64)
+		if err != nil || created > cutoff {
+			continue
+		}
+		(&stagingArea{schema: schema}).drop()
+	}
+}
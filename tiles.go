@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulmach/go.geo"
+	"github.com/paulmach/go.geo/reducers"
+)
+
+const (
+	// tileExtent is the size of a tile in tile coordinates.
+	tileExtent = 4096
+	// tileBuffer is how far beyond its edges a tile keeps geometry, so
+	// lines and stop icons are not cut at tile boundaries.
+	tileBuffer = 64
+	// tileTolerance is how far, in tile coordinates, simplified lines
+	// may stray from the shapes they follow: about half a pixel.
+	tileTolerance = 4.0
+	// minStopZoom is the lowest zoom level tiles carry stops at.
+	minStopZoom = 13
+	maxTileZoom = 24
+
+	maxCachedTiles = 10000
+)
+
+// tileMime is the media type of vector tiles.
+const tileMime = "application/vnd.mapbox-vector-tile"
+
+// tileRoute is a route with the lines its trips follow, for drawing.
+type tileRoute struct {
+	Route
+	lines []*geo.Path
+	bound *geo.Bound
+}
+
+var (
+	tilesMutex sync.Mutex
+	// tileRoutes holds the routes of each feed until it is reloaded.
+	tileRoutes = map[string][]tileRoute{}
+	// tileCache holds rendered tiles by feed and tile until a feed is
+	// reloaded, so every tile is rendered once per version of the feeds.
+	tileCache = map[string][]byte{}
+)
+
+// Tile renders the Mapbox vector tile z/x/y, where y may end in ".mvt",
+// with a "stops" layer from zoom minStopZoom and a "routes" layer.
+func (serv TransitService) Tile(z string, x string, y string, feed string) string {
+	zoom, column, row, err := parseTile(z, x, strings.TrimSuffix(y, ".mvt"))
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(err.Error()))
+		return ""
+	}
+
+	key := fmt.Sprintf("%s\x00%d/%d/%d", feed, zoom, column, row)
+	tilesMutex.Lock()
+	tile, ok := tileCache[key]
+	tilesMutex.Unlock()
+
+	if !ok {
+		generation := feedGeneration("")
+		tile, err = renderTile(feed, zoom, column, row)
+		if err != nil {
+			serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+			return ""
+		}
+
+		tilesMutex.Lock()
+		if len(tileCache) >= maxCachedTiles {
+			tileCache = map[string][]byte{}
+		}
+		if feedGeneration("") == generation {
+			tileCache[key] = tile
+		}
+		tilesMutex.Unlock()
+	}
+
+	serv.ResponseBuilder().SetContentType(tileMime).WriteAndOveride(tile)
+	return ""
+}
+
+// parseTile reads the zoom, column and row of a tile.
+func parseTile(z string, x string, y string) (uint64, uint64, uint64, error) {
+	zoom, err := strconv.ParseUint(z, 10, 64)
+	if err != nil || zoom > maxTileZoom {
+		return 0, 0, 0, fmt.Errorf("invalid zoom %q, expected 0 to %d", z, maxTileZoom)
+	}
+	column, err := strconv.ParseUint(x, 10, 64)
+	if err != nil || column >= 1<<zoom {
+		return 0, 0, 0, fmt.Errorf("invalid tile column %q at zoom %d", x, zoom)
+	}
+	row, err := strconv.ParseUint(y, 10, 64)
+	if err != nil || row >= 1<<zoom {
+		return 0, 0, 0, fmt.Errorf("invalid tile row %q at zoom %d", y, zoom)
+	}
+	return zoom, column, row, nil
+}
+
+// renderTile draws the stops and routes of the feeds the query covers
+// on a tile.
+func renderTile(feed string, z uint64, x uint64, y uint64) ([]byte, error) {
+	feedIds, err := feedIdsFor(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	bound := geo.NewBoundFromMapTile(x, y, z)
+	bound.Pad(bound.Width() * tileBuffer / tileExtent)
+
+	// project maps a lng/lat point to coordinates within the tile.
+	project := func(lng float64, lat float64) [2]float64 {
+		worldX, worldY := geo.ScalarMercator.Project(lng, lat, z+12)
+		return [2]float64{
+			float64(int64(worldX) - int64(x*tileExtent)),
+			float64(int64(worldY) - int64(y*tileExtent)),
+		}
+	}
+
+	stops := newMvtLayer("stops", tileExtent)
+	routes := newMvtLayer("routes", tileExtent)
+
+	for _, feedId := range feedIds {
+		if z >= minStopZoom {
+			index, err := stopIndexFor(feedId)
+			if err != nil {
+				return nil, err
+			}
+
+			center := bound.Center()
+			for _, stop := range index.within(center, center.GeoDistanceFrom(bound.NorthEast(), true), nil) {
+				p := project(stop.StopLon, stop.StopLat)
+				if !inTile(p) {
+					continue
+				}
+
+				geometry := &mvtGeometry{}
+				geometry.moveTo(int(p[0]), int(p[1]))
+				stops.add(mvtPoint, geometry.commands, []mvtProperty{
+					{"feed_id", stop.FeedId},
+					{"stop_id", stop.StopId},
+					{"stop_code", stop.StopCode},
+					{"stop_name", stop.StopName},
+					{"location_type", stop.LocationType},
+				})
+			}
+		}
+
+		all, err := tileRoutesFor(feedId)
+		if err != nil {
+			return nil, err
+		}
+		for _, route := range all {
+			if !route.bound.Intersects(bound) {
+				continue
+			}
+
+			geometry := &mvtGeometry{}
+			for _, line := range route.lines {
+				points := make([][2]float64, 0, line.Length())
+				for _, p := range line.PointSet {
+					points = append(points, project(p.Lng(), p.Lat()))
+				}
+				for _, piece := range clipLine(points, -tileBuffer, tileExtent+tileBuffer) {
+					geometry.line(simplify(piece, tileTolerance))
+				}
+			}
+			if len(geometry.commands) == 0 {
+				continue
+			}
+
+			routeType, _ := strconv.Atoi(route.RouteType)
+			routes.add(mvtLineString, geometry.commands, []mvtProperty{
+				{"feed_id", route.FeedId},
+				{"route_id", route.RouteId},
+				{"route_short_name", route.RouteShortName},
+				{"route_type", routeType},
+				{"route_color", hexColor(route.RouteColor)},
+				{"route_text_color", hexColor(route.RouteTextColor)},
+			})
+		}
+	}
+
+	return encodeTile(stops, routes), nil
+}
+
+// inTile tells whether a point lies on a tile or its buffer.
+func inTile(p [2]float64) bool {
+	return p[0] >= -tileBuffer && p[0] <= tileExtent+tileBuffer &&
+		p[1] >= -tileBuffer && p[1] <= tileExtent+tileBuffer
+}
+
+// hexColor returns a GTFS colour as a CSS one, "#" and six hex digits.
+func hexColor(color string) string {
+	if color == "" {
+		return ""
+	}
+	return "#" + strings.TrimPrefix(color, "#")
+}
+
+// simplify reduces a line with the Douglas-Peucker algorithm.
+func simplify(points [][2]float64, tolerance float64) [][2]float64 {
+	reduced := reducers.DouglasPeucker(geo.NewPathFromXYData(points), tolerance)
+
+	simple := make([][2]float64, 0, reduced.Length())
+	for _, p := range reduced.PointSet {
+		simple = append(simple, [2]float64{p.X(), p.Y()})
+	}
+	return simple
+}
+
+// clipLine cuts a line to the square from min to max, returning the
+// pieces of it inside.
+func clipLine(points [][2]float64, min float64, max float64) [][][2]float64 {
+	pieces := [][][2]float64{}
+
+	var piece [][2]float64
+	for i := 1; i < len(points); i++ {
+		a, b, ok := clipSegment(points[i-1], points[i], min, max)
+		if !ok {
+			continue
+		}
+
+		if piece == nil {
+			piece = [][2]float64{a}
+		}
+		piece = append(piece, b)
+
+		// The line leaves the square after b.
+		if b != points[i] {
+			pieces = append(pieces, piece)
+			piece = nil
+		}
+	}
+	if piece != nil {
+		pieces = append(pieces, piece)
+	}
+
+	return pieces
+}
+
+// clipSegment cuts the segment from a to b to the square from min to
+// max with the Liang-Barsky algorithm, telling whether any of it is
+// inside.
+func clipSegment(a [2]float64, b [2]float64, min float64, max float64) ([2]float64, [2]float64, bool) {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t0, t1 := 0.0, 1.0
+
+	edges := [][2]float64{
+		{-dx, a[0] - min},
+		{dx, max - a[0]},
+		{-dy, a[1] - min},
+		{dy, max - a[1]},
+	}
+	for _, edge := range edges {
+		p, q := edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				return a, b, false
+			}
+			continue
+		}
+
+		r := q / p
+		if p < 0 {
+			if r > t1 {
+				return a, b, false
+			}
+			t0 = math.Max(t0, r)
+		} else {
+			if r < t0 {
+				return a, b, false
+			}
+			t1 = math.Min(t1, r)
+		}
+	}
+
+	start, end := a, b
+	if t0 > 0 {
+		start = [2]float64{a[0] + t0*dx, a[1] + t0*dy}
+	}
+	if t1 < 1 {
+		end = [2]float64{a[0] + t1*dx, a[1] + t1*dy}
+	}
+	return start, end, true
+}
+
+// tileRoutesFor returns the routes of a feed with their shapes, loading
+// them on first use.
+func tileRoutesFor(feedId string) ([]tileRoute, error) {
+	tilesMutex.Lock()
+	all, ok := tileRoutes[feedId]
+	tilesMutex.Unlock()
+	if ok {
+		return all, nil
+	}
+
+	generation := feedGeneration(feedId)
+	started := time.Now()
+	params := map[string]interface{}{
+		"feed": feedId,
+	}
+
+	routes := []Route{}
+	_, err := dbMap.Select(&routes, "select * from route where feedid = :feed order by routeshortname, routeid", params)
+	if err != nil {
+		return nil, err
+	}
+
+	links := []routeShape{}
+	_, err = dbMap.Select(&links, "select distinct feedid, routeid, shapeid from trip where feedid = :feed and shapeid <> ''", params)
+	if err != nil {
+		return nil, err
+	}
+
+	shapes := []Shape{}
+	_, err = dbMap.Select(&shapes, "select * from shape where feedid = :feed order by shapeid, shapeptsequence", params)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := map[string]*geo.Path{}
+	for _, line := range shapeLines(shapes, defaultShapeReducer) {
+		lines[line.ShapeId] = line.path
+	}
+	linesOf := map[string][]*geo.Path{}
+	for _, link := range links {
+		if line, ok := lines[link.ShapeId]; ok {
+			linesOf[link.RouteId] = append(linesOf[link.RouteId], line)
+		}
+	}
+
+	all = []tileRoute{}
+	for _, route := range routes {
+		routeLines := linesOf[route.RouteId]
+		if len(routeLines) == 0 {
+			continue
+		}
+
+		bound := routeLines[0].Bound()
+		for _, line := range routeLines[1:] {
+			bound.Union(line.Bound())
+		}
+		all = append(all, tileRoute{Route: route, lines: routeLines, bound: bound})
+	}
+	log.Printf("Prepared %d routes of feed %s for tiles in %v", len(all), feedId, time.Since(started))
+
+	tilesMutex.Lock()
+	if feedGeneration(feedId) == generation {
+		tileRoutes[feedId] = all
+	}
+	tilesMutex.Unlock()
+	return all, nil
+}
+
+// forgetTiles drops the routes of a feed and every rendered tile, since
+// tiles may draw several feeds.
+func forgetTiles(feedId string) {
+	tilesMutex.Lock()
+	delete(tileRoutes, feedId)
+	tileCache = map[string][]byte{}
+	tilesMutex.Unlock()
+}
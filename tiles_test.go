@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClipSegment(t *testing.T) {
+	tests := []struct {
+		name       string
+		a, b       [2]float64
+		start, end [2]float64
+		inside     bool
+	}{
+		{"inside", [2]float64{2, 2}, [2]float64{8, 8}, [2]float64{2, 2}, [2]float64{8, 8}, true},
+		{"leaving east", [2]float64{5, 5}, [2]float64{15, 5}, [2]float64{5, 5}, [2]float64{10, 5}, true},
+		{"entering from south", [2]float64{5, -10}, [2]float64{5, 5}, [2]float64{5, 0}, [2]float64{5, 5}, true},
+		{"crossing", [2]float64{-5, 5}, [2]float64{15, 5}, [2]float64{0, 5}, [2]float64{10, 5}, true},
+		{"diagonal across a corner", [2]float64{-5, 5}, [2]float64{5, 15}, [2]float64{0, 10}, [2]float64{0, 10}, true},
+		{"outside", [2]float64{12, 0}, [2]float64{12, 10}, [2]float64{}, [2]float64{}, false},
+		{"passing a corner", [2]float64{8, 15}, [2]float64{15, 8}, [2]float64{}, [2]float64{}, false},
+	}
+	for _, test := range tests {
+		start, end, inside := clipSegment(test.a, test.b, 0, 10)
+		if inside != test.inside {
+			t.Errorf("%s: inside = %v, want %v", test.name, inside, test.inside)
+			continue
+		}
+		if inside && (start != test.start || end != test.end) {
+			t.Errorf("%s: clipped to %v-%v, want %v-%v", test.name, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestClipLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		points [][2]float64
+		pieces [][][2]float64
+	}{
+		{
+			"inside",
+			[][2]float64{{1, 1}, {5, 5}, {9, 1}},
+			[][][2]float64{{{1, 1}, {5, 5}, {9, 1}}},
+		},
+		{
+			"crossing an edge",
+			[][2]float64{{5, 5}, {5, 15}},
+			[][][2]float64{{{5, 5}, {5, 10}}},
+		},
+		{
+			"leaving and coming back",
+			[][2]float64{{-10, 5}, {5, 5}, {5, 20}, {15, 20}, {15, 5}, {5, 5}},
+			[][][2]float64{{{0, 5}, {5, 5}, {5, 10}}, {{10, 5}, {5, 5}}},
+		},
+		{
+			"outside",
+			[][2]float64{{20, 20}, {30, 30}},
+			[][][2]float64{},
+		},
+	}
+	for _, test := range tests {
+		if pieces := clipLine(test.points, 0, 10); !reflect.DeepEqual(pieces, test.pieces) {
+			t.Errorf("%s: pieces = %v, want %v", test.name, pieces, test.pieces)
+		}
+	}
+}
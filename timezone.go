@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// serviceDay picks a service date given the timezone of a feed. The date
+// is read from the year, month and day of the returned time; schedule
+// queries resolve it separately for each feed they cover.
+type serviceDay func(loc *time.Location) time.Time
+
+// today is the current service date wherever the feed runs.
+func today() serviceDay {
+	return at(time.Now())
+}
+
+// at is the date an instant falls on in the timezone of the feed.
+func at(instant time.Time) serviceDay {
+	return func(loc *time.Location) time.Time {
+		return instant.In(loc)
+	}
+}
+
+// onDate is the same calendar date for every feed.
+func onDate(date time.Time) serviceDay {
+	return func(loc *time.Location) time.Time {
+		return time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, loc)
+	}
+}
+
+// serviceDayStart returns the instant GTFS times of the service day on
+// the date of day count from: noon minus 12h in the zone of day, which
+// is midnight except on days when the clocks change.
+func serviceDayStart(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, day.Location()).Add(-12 * time.Hour)
+}
+
+// serviceDayOf is the service day starting at start. Its date is read
+// at noon, since the start itself falls on the day before when the
+// clocks go forward overnight.
+func serviceDayOf(start time.Time) serviceDay {
+	return at(start.Add(12 * time.Hour))
+}
+
+// serviceDate returns the date of the service day starting at start.
+func serviceDate(start time.Time) GtfsDate {
+	noon := start.Add(12 * time.Hour)
+	return GtfsDate{time.Date(noon.Year(), noon.Month(), noon.Day(), 0, 0, 0, 0, time.UTC)}
+}
+
+var (
+	locationsMutex sync.Mutex
+	// feedLocations caches the timezone of each feed until it is reloaded.
+	feedLocations = map[string]*time.Location{}
+	// zones caches loaded timezones by name, nil for unknown names.
+	zones = map[string]*time.Location{}
+)
+
+// loadZone loads a named timezone, remembering it for next time.
+func loadZone(name string) (*time.Location, bool) {
+	locationsMutex.Lock()
+	defer locationsMutex.Unlock()
+
+	loc, ok := zones[name]
+	if !ok {
+		loc, _ = time.LoadLocation(name)
+		zones[name] = loc
+	}
+	return loc, loc != nil
+}
+
+// feedLocation returns the timezone a feed's service days are counted
+// in: its agency_timezone, or else the stop_timezone of its stops. When
+// neither names a known zone the server's local zone is used.
+func feedLocation(feedId string) *time.Location {
+	locationsMutex.Lock()
+	loc, ok := feedLocations[feedId]
+	locationsMutex.Unlock()
+	if ok {
+		return loc
+	}
+
+	generation := feedGeneration(feedId)
+	loc = time.Local
+	queries := []string{
+		"select agencytimezone from agency where feedid = $1 and agencytimezone <> '' order by agencyid limit 1",
+		"select stoptimezone from stop where feedid = $1 and stoptimezone <> '' order by stopid limit 1",
+	}
+	for _, query := range queries {
+		name, err := dbMap.SelectNullStr(query, feedId)
+		if err != nil {
+			log.Println("Finding the timezone of feed", feedId, "failed.", err)
+			return time.Local
+		}
+		if !name.Valid {
+			continue
+		}
+		if l, ok := loadZone(name.String); ok {
+			loc = l
+			break
+		}
+		log.Println("Feed", feedId, "has unknown timezone", name.String)
+	}
+
+	locationsMutex.Lock()
+	if feedGeneration(feedId) == generation {
+		feedLocations[feedId] = loc
+	}
+	locationsMutex.Unlock()
+	return loc
+}
+
+// stopLocation returns the timezone local times at a stop are shown in:
+// its stop_timezone where it has one, or else the feed's.
+func stopLocation(feedId string, stopTimezone string) *time.Location {
+	if stopTimezone != "" {
+		if loc, ok := loadZone(stopTimezone); ok {
+			return loc
+		}
+	}
+	return feedLocation(feedId)
+}
+
+// unknownFeedError is returned for a feed parameter naming no loaded
+// feed.
+type unknownFeedError string
+
+func (feed unknownFeedError) Error() string {
+	return fmt.Sprintf("unknown feed %q", string(feed))
+}
+
+// errorStatus returns the status code to respond with for an error
+// answering a query: 404 for a feed that isn't loaded, else 500.
+func errorStatus(err error) int {
+	if _, ok := err.(unknownFeedError); ok {
+		return 404
+	}
+	return 500
+}
+
+// feedIdsFor lists the feeds a query scoped to feed covers: just that
+// one, or every loaded feed when it is empty. A feed that isn't loaded
+// is an unknownFeedError, so that nothing is cached for it.
+func feedIdsFor(feed string) ([]string, error) {
+	if feed != "" {
+		count, err := dbMap.SelectInt("select count(*) from feed where feedid = $1", feed)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, unknownFeedError(feed)
+		}
+		return []string{feed}, nil
+	}
+
+	feedIds := []string{}
+	_, err := dbMap.Select(&feedIds, "select feedid from feed order by feedid")
+	return feedIds, err
+}
+
+// forgetLocation drops the cached timezone of a feed.
+func forgetLocation(feedId string) {
+	locationsMutex.Lock()
+	delete(feedLocations, feedId)
+	locationsMutex.Unlock()
+}
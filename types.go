@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"gopkg.in/gorp.v1"
+)
+
+// GtfsTime is a GTFS time stored as seconds since the start of the
+// service day, noon minus 12h, so it sorts and compares as an integer.
+// Times past midnight run over 86400. NoTime marks an absent time and is
+// stored as NULL.
+type GtfsTime int
+
+// NoTime is the GtfsTime of a stop time that has no time of its own.
+const NoTime GtfsTime = -1
+
+// newGtfsTime parses a GTFS H:MM:SS time, giving NoTime for an empty or
+// invalid one.
+func newGtfsTime(value string) GtfsTime {
+	seconds, err := parseGtfsTime(value)
+	if err != nil {
+		return NoTime
+	}
+	return GtfsTime(seconds)
+}
+
+// Valid reports whether the time is set.
+func (t GtfsTime) Valid() bool {
+	return t >= 0
+}
+
+// String formats the time as GTFS HH:MM:SS, or "" when absent.
+func (t GtfsTime) String() string {
+	if !t.Valid() {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d:%02d", int(t)/3600, int(t)/60%60, int(t)%60)
+}
+
+func (t GtfsTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *GtfsTime) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*t = newGtfsTime(value)
+	return nil
+}
+
+func (t GtfsTime) Value() (driver.Value, error) {
+	if !t.Valid() {
+		return nil, nil
+	}
+	return int64(t), nil
+}
+
+func (t *GtfsTime) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*t = NoTime
+	case int64:
+		*t = GtfsTime(v)
+	case []byte:
+		n, err := strconv.Atoi(string(v))
+		if err != nil {
+			return err
+		}
+		*t = GtfsTime(n)
+	default:
+		return fmt.Errorf("cannot scan %T into GtfsTime", src)
+	}
+	return nil
+}
+
+// GtfsDate is a GTFS date stored as an SQL DATE. The zero date is stored
+// as NULL.
+type GtfsDate struct {
+	time.Time
+}
+
+// newGtfsDate parses a GTFS YYYYMMDD date, giving the zero date for an
+// empty or invalid one.
+func newGtfsDate(value string) GtfsDate {
+	date, err := parseGtfsDate(value)
+	if err != nil {
+		return GtfsDate{}
+	}
+	return GtfsDate{date}
+}
+
+// String formats the date as GTFS YYYYMMDD, or "" when absent.
+func (d GtfsDate) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format("20060102")
+}
+
+func (d GtfsDate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *GtfsDate) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*d = newGtfsDate(value)
+	return nil
+}
+
+func (d GtfsDate) Value() (driver.Value, error) {
+	if d.IsZero() {
+		return nil, nil
+	}
+	return d.Format("2006-01-02"), nil
+}
+
+func (d *GtfsDate) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = GtfsDate{}
+	case time.Time:
+		*d = GtfsDate{time.Date(v.Year(), v.Month(), v.Day(), 0, 0, 0, 0, time.UTC)}
+	case []byte:
+		date, err := time.Parse("2006-01-02", string(v))
+		if err != nil {
+			return err
+		}
+		*d = GtfsDate{date}
+	default:
+		return fmt.Errorf("cannot scan %T into GtfsDate", src)
+	}
+	return nil
+}
+
+// tamerDialect is the PostgreSQL dialect, knowing the column type of a
+// GtfsDate.
+type tamerDialect struct {
+	gorp.PostgresDialect
+}
+
+func (d tamerDialect) ToSqlType(val reflect.Type, maxsize int, isAutoIncr bool) string {
+	if val == reflect.TypeOf(GtfsDate{}) {
+		return "date"
+	}
+	return d.PostgresDialect.ToSqlType(val, maxsize, isAutoIncr)
+}
+
+// columnConversions turn the text columns of earlier schemas into the
+// typed ones, keyed by the Go type of the field.
+var columnConversions = map[reflect.Type]string{
+	reflect.TypeOf(GtfsTime(0)): "case when %[1]s ~ '^\\d+:\\d\\d:\\d\\d$' then " +
+		"split_part(%[1]s, ':', 1)::integer * 3600 + split_part(%[1]s, ':', 2)::integer * 60 + split_part(%[1]s, ':', 3)::integer end",
+	reflect.TypeOf(GtfsDate{}): "case when %[1]s ~ '^\\d{8}$' then to_date(%[1]s, 'YYYYMMDD') end",
+	reflect.TypeOf(0):          "case when %[1]s ~ '^-?\\d+$' then %[1]s::integer else 0 end",
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIssues caps how many issues of each severity a report lists; the
+// counts keep going past it.
+const maxIssues = 1000
+
+// ValidationIssue is a single problem found in a feed.
+type ValidationIssue struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationReport lists the problems found in a feed. A feed with any
+// errors is refused; warnings are reported but do not block a load.
+type ValidationReport struct {
+	FeedId       string            `json:"feed_id"`
+	Source       string            `json:"source"`
+	ErrorCount   int               `json:"error_count"`
+	WarningCount int               `json:"warning_count"`
+	Errors       []ValidationIssue `json:"errors"`
+	Warnings     []ValidationIssue `json:"warnings"`
+}
+
+// Valid reports whether the feed had no errors.
+func (report *ValidationReport) Valid() bool {
+	return report.ErrorCount == 0
+}
+
+func (report *ValidationReport) addError(file string, line int, field string, format string, args ...interface{}) {
+	report.ErrorCount++
+	if len(report.Errors) < maxIssues {
+		report.Errors = append(report.Errors, ValidationIssue{file, line, field, fmt.Sprintf(format, args...)})
+	}
+}
+
+func (report *ValidationReport) addWarning(file string, line int, field string, format string, args ...interface{}) {
+	report.WarningCount++
+	if len(report.Warnings) < maxIssues {
+		report.Warnings = append(report.Warnings, ValidationIssue{file, line, field, fmt.Sprintf(format, args...)})
+	}
+}
+
+var (
+	reportsMutex sync.Mutex
+	// lastReports holds the report of the most recent load of each feed.
+	lastReports = map[string]*ValidationReport{}
+)
+
+func saveReport(report *ValidationReport) {
+	reportsMutex.Lock()
+	defer reportsMutex.Unlock()
+	lastReports[report.FeedId] = report
+}
+
+func lastReport(feedId string) (*ValidationReport, bool) {
+	reportsMutex.Lock()
+	defer reportsMutex.Unlock()
+	report, ok := lastReports[feedId]
+	return report, ok
+}
+
+// idFiles names the file that defines each kind of ID, for messages.
+var idFiles = map[string]string{
+	"agency":  "agency.txt",
+	"stop":    "stops.txt",
+	"route":   "routes.txt",
+	"service": "calendar.txt or calendar_dates.txt",
+	"shape":   "shapes.txt",
+	"trip":    "trips.txt",
+	"level":   "levels.txt",
+	"fare":    "fare_attributes.txt",
+}
+
+// tripProgress tracks the last stop time seen for a trip, to check that
+// sequences and times only move forward.
+type tripProgress struct {
+	sequence int
+	time     int
+	timed    bool
+}
+
+// reference is a check that can only run once a whole file has been read.
+type reference struct {
+	kind  string
+	id    string
+	file  string
+	line  int
+	field string
+}
+
+// feedValidator checks the records of a feed as they stream past. Files
+// must arrive in gtfsFileOrder so that references can be checked inline.
+type feedValidator struct {
+	report   *ValidationReport
+	files    map[string]bool
+	ids      map[string]map[string]bool
+	keys     map[string]map[string]int
+	trips    map[string]*tripProgress
+	shapes   map[string][]int
+	zones    map[string]bool
+	deferred []reference
+	agencies int
+	noAgency int
+
+	unorderedShapes bool
+}
+
+func newFeedValidator(feedId string, source string) *feedValidator {
+	return &feedValidator{
+		report: &ValidationReport{
+			FeedId:   feedId,
+			Source:   source,
+			Errors:   []ValidationIssue{},
+			Warnings: []ValidationIssue{},
+		},
+		files:  map[string]bool{},
+		ids:    map[string]map[string]bool{},
+		keys:   map[string]map[string]int{},
+		trips:  map[string]*tripProgress{},
+		shapes: map[string][]int{},
+		zones:  map[string]bool{},
+	}
+}
+
+// define records an ID that other files may refer to.
+func (v *feedValidator) define(kind string, id string) {
+	if v.ids[kind] == nil {
+		v.ids[kind] = map[string]bool{}
+	}
+	v.ids[kind][id] = true
+}
+
+// unique reports a key that was already used earlier in the file.
+func (v *feedValidator) unique(file string, line int, field string, key string) {
+	if v.keys[file] == nil {
+		v.keys[file] = map[string]int{}
+	}
+	if first, seen := v.keys[file][key]; seen {
+		v.report.addError(file, line, field, "duplicate %s %q, first defined on line %d", field, key, first)
+		return
+	}
+	v.keys[file][key] = line
+}
+
+// refer reports a non-empty ID that no earlier file defined.
+func (v *feedValidator) refer(kind string, id string, file string, line int, field string) {
+	if id == "" || v.ids[kind][id] {
+		return
+	}
+	v.report.addError(file, line, field, "%s %q not found in %s", field, id, idFiles[kind])
+}
+
+func (v *feedValidator) required(h csvHeader, r []string, file string, line int, fields ...string) {
+	for _, field := range fields {
+		if h.get(r, field) == "" {
+			v.report.addError(file, line, field, "missing required value")
+		}
+	}
+}
+
+func (v *feedValidator) coordinates(h csvHeader, r []string, file string, line int, latField string, lonField string) {
+	lat, latErr := strconv.ParseFloat(h.get(r, latField), 64)
+	if latErr != nil {
+		v.report.addError(file, line, latField, "invalid latitude %q", h.get(r, latField))
+	} else if lat < -90 || lat > 90 {
+		v.report.addError(file, line, latField, "latitude %v out of range", lat)
+	}
+
+	lon, lonErr := strconv.ParseFloat(h.get(r, lonField), 64)
+	if lonErr != nil {
+		v.report.addError(file, line, lonField, "invalid longitude %q", h.get(r, lonField))
+	} else if lon < -180 || lon > 180 {
+		v.report.addError(file, line, lonField, "longitude %v out of range", lon)
+	}
+
+	if latErr == nil && lonErr == nil && lat == 0 && lon == 0 {
+		v.report.addWarning(file, line, latField, "coordinates are 0,0")
+	}
+}
+
+func (v *feedValidator) date(h csvHeader, r []string, file string, line int, field string) {
+	if value := h.get(r, field); value != "" {
+		if _, err := parseGtfsDate(value); err != nil {
+			v.report.addError(file, line, field, "invalid date %q, expected YYYYMMDD", value)
+		}
+	}
+}
+
+func (v *feedValidator) integer(h csvHeader, r []string, file string, line int, field string, allowed ...int) {
+	value := h.get(r, field)
+	if value == "" {
+		return
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		v.report.addError(file, line, field, "invalid integer %q", value)
+		return
+	}
+	if len(allowed) == 0 {
+		return
+	}
+	for _, a := range allowed {
+		if n == a {
+			return
+		}
+	}
+	v.report.addError(file, line, field, "unexpected value %d", n)
+}
+
+func (v *feedValidator) timezone(h csvHeader, r []string, file string, line int, field string) {
+	value := h.get(r, field)
+	if value == "" {
+		return
+	}
+
+	known, checked := v.zones[value]
+	if !checked {
+		_, err := time.LoadLocation(value)
+		known = err == nil
+		v.zones[value] = known
+	}
+	if !known {
+		v.report.addError(file, line, field, "unknown timezone %q", value)
+	}
+}
+
+// header checks the columns of a file before its records are read.
+func (v *feedValidator) header(file string, spec gtfsFile, h csvHeader) {
+	v.files[file] = true
+
+	for _, column := range h.missing(spec.required) {
+		v.report.addError(file, 1, column, "missing required column")
+	}
+	for _, column := range h.unknown(spec.required, spec.optional) {
+		v.report.addWarning(file, 1, column, "unknown column ignored")
+	}
+}
+
+// unsupported notes a file in the feed that is not loaded.
+func (v *feedValidator) unsupported(file string) {
+	v.report.addWarning(file, 0, "", "unsupported file ignored")
+}
+
+// record checks one record of a file.
+func (v *feedValidator) record(file string, line int, h csvHeader, r []string) {
+	switch file {
+	case "agency.txt":
+		v.required(h, r, file, line, "agency_name", "agency_url", "agency_timezone")
+		v.timezone(h, r, file, line, "agency_timezone")
+		v.agencies++
+		if id := h.get(r, "agency_id"); id != "" {
+			v.unique(file, line, "agency_id", id)
+			v.define("agency", id)
+		} else {
+			v.noAgency++
+		}
+
+	case "levels.txt":
+		v.required(h, r, file, line, "level_id", "level_index")
+		v.unique(file, line, "level_id", h.get(r, "level_id"))
+		v.define("level", h.get(r, "level_id"))
+
+	case "stops.txt":
+		v.required(h, r, file, line, "stop_id")
+		v.unique(file, line, "stop_id", h.get(r, "stop_id"))
+		v.define("stop", h.get(r, "stop_id"))
+		v.integer(h, r, file, line, "location_type", 0, 1, 2, 3, 4)
+
+		locationType := h.get(r, "location_type")
+		if locationType == "" || locationType == "0" || locationType == "1" || locationType == "2" {
+			v.required(h, r, file, line, "stop_name")
+			v.coordinates(h, r, file, line, "stop_lat", "stop_lon")
+		}
+		if parent := h.get(r, "parent_station"); parent != "" {
+			v.deferred = append(v.deferred, reference{"stop", parent, file, line, "parent_station"})
+		}
+		v.refer("level", h.get(r, "level_id"), file, line, "level_id")
+		v.timezone(h, r, file, line, "stop_timezone")
+
+	case "routes.txt":
+		v.required(h, r, file, line, "route_id", "route_type")
+		v.unique(file, line, "route_id", h.get(r, "route_id"))
+		v.define("route", h.get(r, "route_id"))
+		v.integer(h, r, file, line, "route_type")
+		if h.get(r, "route_short_name") == "" && h.get(r, "route_long_name") == "" {
+			v.report.addError(file, line, "route_short_name", "one of route_short_name or route_long_name is required")
+		}
+		v.refer("agency", h.get(r, "agency_id"), file, line, "agency_id")
+
+	case "calendar.txt":
+		v.required(h, r, file, line, "service_id", "start_date", "end_date")
+		v.unique(file, line, "service_id", h.get(r, "service_id"))
+		v.define("service", h.get(r, "service_id"))
+		for _, day := range []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"} {
+			v.required(h, r, file, line, day)
+			v.integer(h, r, file, line, day, 0, 1)
+		}
+		v.date(h, r, file, line, "start_date")
+		v.date(h, r, file, line, "end_date")
+		if h.get(r, "start_date") > h.get(r, "end_date") {
+			v.report.addError(file, line, "end_date", "end_date %s is before start_date %s", h.get(r, "end_date"), h.get(r, "start_date"))
+		}
+
+	case "calendar_dates.txt":
+		v.required(h, r, file, line, "service_id", "date", "exception_type")
+		v.unique(file, line, "date", h.get(r, "service_id")+" on "+h.get(r, "date"))
+		v.define("service", h.get(r, "service_id"))
+		v.date(h, r, file, line, "date")
+		v.integer(h, r, file, line, "exception_type", 1, 2)
+
+	case "shapes.txt":
+		v.required(h, r, file, line, "shape_id", "shape_pt_sequence")
+		v.define("shape", h.get(r, "shape_id"))
+		v.coordinates(h, r, file, line, "shape_pt_lat", "shape_pt_lon")
+		v.integer(h, r, file, line, "shape_pt_sequence")
+		v.shapePoint(h, r, file, line)
+
+	case "trips.txt":
+		v.required(h, r, file, line, "route_id", "service_id", "trip_id")
+		v.unique(file, line, "trip_id", h.get(r, "trip_id"))
+		v.define("trip", h.get(r, "trip_id"))
+		v.refer("route", h.get(r, "route_id"), file, line, "route_id")
+		v.refer("service", h.get(r, "service_id"), file, line, "service_id")
+		v.refer("shape", h.get(r, "shape_id"), file, line, "shape_id")
+		v.integer(h, r, file, line, "direction_id", 0, 1)
+
+	case "stop_times.txt":
+		v.required(h, r, file, line, "trip_id", "stop_id", "stop_sequence")
+		v.refer("trip", h.get(r, "trip_id"), file, line, "trip_id")
+		v.refer("stop", h.get(r, "stop_id"), file, line, "stop_id")
+		v.stopTime(h, r, file, line)
+
+	case "frequencies.txt":
+		v.required(h, r, file, line, "trip_id", "start_time", "end_time", "headway_secs")
+		v.refer("trip", h.get(r, "trip_id"), file, line, "trip_id")
+		v.integer(h, r, file, line, "headway_secs")
+
+	case "transfers.txt":
+		v.refer("stop", h.get(r, "from_stop_id"), file, line, "from_stop_id")
+		v.refer("stop", h.get(r, "to_stop_id"), file, line, "to_stop_id")
+		v.refer("route", h.get(r, "from_route_id"), file, line, "from_route_id")
+		v.refer("route", h.get(r, "to_route_id"), file, line, "to_route_id")
+		v.refer("trip", h.get(r, "from_trip_id"), file, line, "from_trip_id")
+		v.refer("trip", h.get(r, "to_trip_id"), file, line, "to_trip_id")
+		v.integer(h, r, file, line, "transfer_type", 0, 1, 2, 3, 4, 5)
+
+	case "pathways.txt":
+		v.required(h, r, file, line, "pathway_id", "from_stop_id", "to_stop_id", "pathway_mode", "is_bidirectional")
+		v.unique(file, line, "pathway_id", h.get(r, "pathway_id"))
+		v.refer("stop", h.get(r, "from_stop_id"), file, line, "from_stop_id")
+		v.refer("stop", h.get(r, "to_stop_id"), file, line, "to_stop_id")
+
+	case "fare_attributes.txt":
+		v.required(h, r, file, line, "fare_id", "price", "currency_type", "payment_method")
+		v.unique(file, line, "fare_id", h.get(r, "fare_id"))
+		v.define("fare", h.get(r, "fare_id"))
+		v.refer("agency", h.get(r, "agency_id"), file, line, "agency_id")
+
+	case "fare_rules.txt":
+		v.required(h, r, file, line, "fare_id")
+		v.refer("fare", h.get(r, "fare_id"), file, line, "fare_id")
+		v.refer("route", h.get(r, "route_id"), file, line, "route_id")
+	}
+}
+
+// stopTime checks that each trip's stop_sequence and times increase.
+// Rows for a trip are expected in stop_sequence order; when they are not
+// the ordering can't be checked and a warning is raised instead.
+func (v *feedValidator) stopTime(h csvHeader, r []string, file string, line int) {
+	tripId := h.get(r, "trip_id")
+
+	sequence, err := strconv.Atoi(h.get(r, "stop_sequence"))
+	if err != nil {
+		v.report.addError(file, line, "stop_sequence", "invalid stop_sequence %q", h.get(r, "stop_sequence"))
+		return
+	}
+
+	arrival, departure := h.get(r, "arrival_time"), h.get(r, "departure_time")
+	timed := arrival != "" || departure != ""
+	if arrival == "" {
+		arrival = departure
+	}
+	if departure == "" {
+		departure = arrival
+	}
+
+	var arrivalSecs, departureSecs int
+	if timed {
+		if arrivalSecs, err = parseGtfsTime(arrival); err != nil {
+			v.report.addError(file, line, "arrival_time", "%v", err)
+			timed = false
+		} else if departureSecs, err = parseGtfsTime(departure); err != nil {
+			v.report.addError(file, line, "departure_time", "%v", err)
+			timed = false
+		} else if departureSecs < arrivalSecs {
+			v.report.addError(file, line, "departure_time", "departure_time %s is before arrival_time %s", departure, arrival)
+		}
+	}
+
+	previous, seen := v.trips[tripId]
+	if !seen {
+		if !timed {
+			v.report.addError(file, line, "arrival_time", "first stop of trip %q has no times", tripId)
+		}
+		v.trips[tripId] = &tripProgress{sequence: sequence, time: departureSecs, timed: timed}
+		return
+	}
+
+	switch {
+	case sequence == previous.sequence:
+		v.report.addError(file, line, "stop_sequence", "duplicate stop_sequence %d for trip %q", sequence, tripId)
+	case sequence < previous.sequence:
+		v.report.addWarning(file, line, "stop_sequence", "stop_times for trip %q are not in stop_sequence order", tripId)
+	case timed && previous.timed && arrivalSecs < previous.time:
+		v.report.addError(file, line, "arrival_time", "trip %q arrives at %s, before it left the previous stop", tripId, arrival)
+	}
+
+	previous.sequence = sequence
+	if timed {
+		previous.time = departureSecs
+		previous.timed = true
+	}
+}
+
+// shapePoint checks that each shape's points have distinct sequences.
+// The sequences of each shape are kept sorted, so a duplicate is found
+// wherever in the file it comes; points in order are simply appended.
+func (v *feedValidator) shapePoint(h csvHeader, r []string, file string, line int) {
+	shapeId := h.get(r, "shape_id")
+	sequence, err := strconv.Atoi(h.get(r, "shape_pt_sequence"))
+	if err != nil {
+		return
+	}
+
+	sequences := v.shapes[shapeId]
+	i := len(sequences)
+	if i > 0 && sequence <= sequences[i-1] {
+		i = sort.SearchInts(sequences, sequence)
+		if sequences[i] == sequence {
+			v.report.addError(file, line, "shape_pt_sequence", "duplicate shape_pt_sequence %d for shape %q", sequence, shapeId)
+			return
+		}
+		if !v.unorderedShapes {
+			v.report.addWarning(file, line, "shape_pt_sequence", "shapes.txt is not in shape_pt_sequence order, starting with shape %q", shapeId)
+		}
+		v.unorderedShapes = true
+	}
+	sequences = append(sequences, 0)
+	copy(sequences[i+1:], sequences[i:])
+	sequences[i] = sequence
+	v.shapes[shapeId] = sequences
+}
+
+// finish runs the checks that need the whole feed and returns the report.
+func (v *feedValidator) finish() *ValidationReport {
+	for _, file := range []string{"agency.txt", "stops.txt", "routes.txt", "trips.txt", "stop_times.txt"} {
+		if !v.files[file] {
+			v.report.addError(file, 0, "", "required file missing")
+		}
+	}
+	if !v.files["calendar.txt"] && !v.files["calendar_dates.txt"] {
+		v.report.addError("calendar.txt", 0, "", "feed needs calendar.txt or calendar_dates.txt")
+	}
+
+	if v.agencies > 1 && v.noAgency > 0 {
+		v.report.addError("agency.txt", 0, "agency_id", "agency_id is required when a feed has more than one agency")
+	}
+
+	for _, ref := range v.deferred {
+		v.refer(ref.kind, ref.id, ref.file, ref.line, ref.field)
+	}
+
+	return v.report
+}
+
+// validateFeed checks every file of a feed without touching the database.
+func validateFeed(feedId string, feed *gtfsFeed) (*ValidationReport, error) {
+	validator := newFeedValidator(feedId, feed.source)
+
+	for _, f := range feed.files {
+		spec, known := gtfsFiles[f.name]
+		if !known {
+			validator.unsupported(f.name)
+			continue
+		}
+
+		rc, err := f.open()
+		if err != nil {
+			return nil, err
+		}
+		err = scanFile(f.name, spec, rc, validator, nil)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", f.name, err)
+		}
+	}
+
+	return validator.finish(), nil
+}
+
+// validateOnly validates a feed for the -validate flag, printing the
+// report as JSON, and returns the exit status: 1 if the feed has errors.
+func validateOnly(feedId string, source string) int {
+	if source == "" {
+		log.Println("-validate needs a feed given with -feed")
+		return 2
+	}
+
+	feed, err := openFeed(source)
+	if err != nil {
+		log.Println("Opening", source, "failed.", err)
+		return 2
+	}
+	defer feed.Close()
+
+	report, err := validateFeed(feedId, feed)
+	if err != nil {
+		log.Println("Validating", source, "failed.", err)
+		return 2
+	}
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+
+	if !report.Valid() {
+		return 1
+	}
+	return 0
+}
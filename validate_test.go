@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testFeed returns a feed of the files given by name and contents.
+func testFeed(files map[string]string) *gtfsFeed {
+	feed := &gtfsFeed{source: "test"}
+	for name, content := range files {
+		content := content
+		feed.files = append(feed.files, feedFile{
+			name: name,
+			open: func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader(content)), nil },
+		})
+	}
+	feed.sort()
+	return feed
+}
+
+func TestValidateShapes(t *testing.T) {
+	files := map[string]string{
+		"agency.txt":         "agency_name,agency_url,agency_timezone\nTransit,http://example.com,America/Toronto\n",
+		"stops.txt":          "stop_id,stop_name,stop_lat,stop_lon\nA,A,45.0,-75.0\nB,B,45.1,-75.0\n",
+		"routes.txt":         "route_id,route_short_name,route_type\nR,1,3\n",
+		"calendar_dates.txt": "service_id,date,exception_type\nS,20260302,1\n",
+		"trips.txt":          "route_id,service_id,trip_id,shape_id\nR,S,T,P\n",
+		"stop_times.txt":     "trip_id,arrival_time,departure_time,stop_id,stop_sequence\nT,08:00:00,08:00:00,A,1\nT,08:10:00,08:10:00,B,2\n",
+	}
+
+	tests := []struct {
+		name     string
+		shapes   string
+		errors   []int
+		warnings int
+	}{
+		{"in order", "P,45.0,-75.0,1\nP,45.05,-75.0,2\nP,45.1,-75.0,3\n", []int{}, 0},
+		{"repeated in order", "P,45.0,-75.0,1\nP,45.05,-75.0,2\nP,45.1,-75.0,2\n", []int{4}, 0},
+		{"out of order", "P,45.1,-75.0,3\nP,45.0,-75.0,1\nQ,45.0,-75.0,1\nP,45.05,-75.0,2\n", []int{}, 1},
+		{"repeated out of order", "P,45.0,-75.0,1\nP,45.05,-75.0,2\nP,45.1,-75.0,3\nQ,45.0,-75.0,1\nP,45.0,-75.0,1\nP,45.0,-75.0,3\n", []int{6, 7}, 0},
+	}
+	for _, test := range tests {
+		files["shapes.txt"] = "shape_id,shape_pt_lat,shape_pt_lon,shape_pt_sequence\n" + test.shapes
+		report, err := validateFeed("test", testFeed(files))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := []int{}
+		for _, issue := range report.Errors {
+			if issue.File != "shapes.txt" || issue.Field != "shape_pt_sequence" {
+				t.Errorf("%s: unexpected error %+v", test.name, issue)
+				continue
+			}
+			lines = append(lines, issue.Line)
+		}
+		if !reflect.DeepEqual(lines, test.errors) {
+			t.Errorf("%s: errors on lines %v, want %v", test.name, lines, test.errors)
+		}
+		if report.WarningCount != test.warnings {
+			t.Errorf("%s: %d warnings %+v, want %d", test.name, report.WarningCount, report.Warnings, test.warnings)
+		}
+	}
+}
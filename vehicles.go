@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/paulmach/go.geo"
+)
+
+// ScheduledVehicle is where a trip should be at a time by its schedule
+// alone, heading for its next stop.
+type ScheduledVehicle struct {
+	FeedId       string    `json:"feed_id"`
+	TripId       string    `json:"trip_id"`
+	RouteId      string    `json:"route_id"`
+	DirectionId  int       `json:"direction_id,string"`
+	TripHeadsign string    `json:"trip_headsign"`
+	ServiceDate  GtfsDate  `json:"service_date"`
+	Lat          float64   `json:"lat"`
+	Lon          float64   `json:"lon"`
+	Bearing      float64   `json:"bearing"`
+	NextStop     Stop      `json:"next_stop"`
+	NextArrival  time.Time `json:"next_arrival"`
+}
+
+// ScheduledVehicles estimates where every trip of a route in service at
+// a time, now unless given as for Plan, should be. Vehicles are placed
+// between the stops they last left and call at next in proportion to
+// the time elapsed, along the trip's shape when it has one.
+func (serv TransitService) ScheduledVehicles(routeId string, at string, feed string) []ScheduledVehicle {
+	all := []ScheduledVehicle{}
+
+	if routeId == "" {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte("missing routeId"))
+		return all
+	}
+	if _, err := parseFrom(at, time.Now()); err != nil {
+		serv.ResponseBuilder().SetResponseCode(400).WriteAndOveride([]byte(fmt.Sprintf("invalid at %q, expected RFC 3339 or HH:MM[:SS]", at)))
+		return all
+	}
+
+	feedIds, err := feedIdsFor(feed)
+	if err != nil {
+		serv.ResponseBuilder().SetResponseCode(errorStatus(err)).WriteAndOveride([]byte(err.Error()))
+		return all
+	}
+	for _, feedId := range feedIds {
+		some, err := estimateVehicles(feedId, routeId, at)
+		if err != nil {
+			serv.ResponseBuilder().SetResponseCode(500).WriteAndOveride([]byte(err.Error()))
+			return []ScheduledVehicle{}
+		}
+		all = append(all, some...)
+	}
+
+	return all
+}
+
+// estimateVehicles places the trips of a route in one feed in service
+// at a time.
+func estimateVehicles(feedId string, routeId string, at string) ([]ScheduledVehicle, error) {
+	loc := feedLocation(feedId)
+	instant, err := parseFrom(at, time.Now().In(loc))
+	if err != nil {
+		return nil, err
+	}
+	start := serviceDayStart(instant.In(loc))
+
+	tt, err := timetableFor(feedId, start)
+	if err != nil {
+		return nil, err
+	}
+	now := int(instant.Sub(start) / time.Second)
+
+	type inService struct {
+		pattern *pattern
+		run     tripRun
+	}
+	running := []inService{}
+	shapeIds := textArray{}
+	for p := range tt.patterns {
+		pattern := &tt.patterns[p]
+		last := len(pattern.stops) - 1
+		for _, run := range pattern.runs {
+			trip := tt.trips[run.trip]
+			if trip.RouteId != routeId || now < run.departures[0] || now >= run.arrivals[last] {
+				continue
+			}
+			running = append(running, inService{pattern, run})
+			if trip.ShapeId != "" {
+				shapeIds = append(shapeIds, trip.ShapeId)
+			}
+		}
+	}
+	if len(running) == 0 {
+		return []ScheduledVehicle{}, nil
+	}
+
+	shapes := []Shape{}
+	_, err = dbMap.Select(&shapes, "select * from shape where feedid = :feed and shapeid = any(cast(:shapes as text[])) "+
+		"order by shapeid, shapeptsequence", map[string]interface{}{
+		"feed":   feedId,
+		"shapes": shapeIds,
+	})
+	if err != nil {
+		return nil, err
+	}
+	paths := map[string]*geo.Path{}
+	for _, line := range shapeLines(shapes, func(path *geo.Path) *geo.Path { return path }) {
+		paths[line.ShapeId] = line.path
+	}
+
+	vehicles := []ScheduledVehicle{}
+	for _, vehicle := range running {
+		trip := tt.trips[vehicle.run.trip]
+		next := nextStop(vehicle.run, now)
+		from, to := &tt.stops[vehicle.pattern.stops[next-1]], &tt.stops[vehicle.pattern.stops[next]]
+
+		fraction := 0.0
+		if left := vehicle.run.departures[next-1]; now > left {
+			fraction = float64(now-left) / float64(vehicle.run.arrivals[next]-left)
+		}
+		position, bearing, ok := alongShape(paths[trip.ShapeId], stopPoint(from), stopPoint(to), fraction)
+		if !ok {
+			line := geo.NewLine(stopPoint(from), stopPoint(to))
+			position, bearing = line.Interpolate(fraction), compassBearing(line.A(), line.B())
+		}
+
+		vehicles = append(vehicles, ScheduledVehicle{
+			FeedId:       feedId,
+			TripId:       trip.TripId,
+			RouteId:      trip.RouteId,
+			DirectionId:  trip.DirectionId,
+			TripHeadsign: trip.TripHeadsign,
+			ServiceDate:  trip.ServiceDate,
+			Lat:          position.Lat(),
+			Lon:          position.Lng(),
+			Bearing:      bearing,
+			NextStop:     *to,
+			NextArrival:  tt.start.Add(time.Duration(vehicle.run.arrivals[next]) * time.Second),
+		})
+	}
+	sort.SliceStable(vehicles, func(i, j int) bool {
+		return vehicles[i].TripId < vehicles[j].TripId
+	})
+
+	return vehicles, nil
+}
+
+// nextStop returns the position of the first stop a run arrives at
+// after now. The run must have left its first stop and not yet reached
+// its last.
+func nextStop(run tripRun, now int) int {
+	return sort.Search(len(run.arrivals), func(i int) bool {
+		return run.arrivals[i] > now
+	})
+}
+
+// alongShape places a vehicle a fraction of the way from one stop to
+// the next along a shape, returning the point and the bearing of the
+// shape there. It tells whether the stops fall in order along the shape;
+// where a shape doubles back on itself they may not.
+func alongShape(path *geo.Path, from *geo.Point, to *geo.Point, fraction float64) (*geo.Point, float64, bool) {
+	if path == nil || path.Length() < 2 {
+		return nil, 0, false
+	}
+	start, end := path.Measure(from), path.Measure(to)
+	if end <= start {
+		return nil, 0, false
+	}
+
+	target := start + (end-start)*fraction
+	travelled := 0.0
+	for i := 1; i < path.Length(); i++ {
+		segment := geo.NewLine(path.GetAt(i-1), path.GetAt(i))
+		length := segment.Distance()
+		if length > 0 && travelled+length >= target {
+			return segment.Interpolate((target - travelled) / length), compassBearing(segment.A(), segment.B()), true
+		}
+		travelled += length
+	}
+	return nil, 0, false
+}